@@ -137,13 +137,22 @@ type authImpl struct {
 // state is not synchronized with ns_server yet or anymore.
 type DBStaleError struct {
 	Err error
+	// WasConnected is true if revrpc connection to ns_server was
+	// established at some point, i.e. the connection was lost rather
+	// than never made.
+	WasConnected bool
 }
 
 func (e *DBStaleError) Error() string {
-	if e.Err != nil {
-		return fmt.Sprintf("CBAuth database is stale: last reason: %s", e.Err)
+	if e.Err == nil {
+		return "CBAuth database is stale. Was never updated yet."
 	}
-	return "CBAuth database is stale. Was never updated yet."
+	if e.WasConnected {
+		return fmt.Sprintf("CBAuth database is stale: last reason: %s "+
+			"(connection to ns_server was lost)", e.Err)
+	}
+	return fmt.Sprintf("CBAuth database is stale: last reason: %s "+
+		"(never connected to ns_server)", e.Err)
 }
 
 // ErrNoAuth is an error that is returned when the user credentials
@@ -154,6 +163,9 @@ var ErrNoAuth = cbauthimpl.ErrNoAuth
 // empty
 var ErrNoUuid = cbauthimpl.ErrNoUuid
 
+// ErrUserNotFound is returned by GetUserAuthInfo for unknown users.
+var ErrUserNotFound = cbauthimpl.ErrUserNotFound
+
 // UnknownHostPortError is returned from GetMemcachedServiceAuth and
 // GetHTTPServiceAuth calls for unknown host:port arguments.
 type UnknownHostPortError string
@@ -208,6 +220,17 @@ func (a *authImpl) Auth(user, pwd string) (creds Creds, err error) {
 	return cbauthimpl.VerifyPassword(a.svc, user, pwd)
 }
 
+// GetUserAuthInfo returns SCRAM-SHA credentials data of given local
+// user together with Creds that represent the user. It is used by
+// cbauth/sasl to authenticate users without handling their passwords.
+func (a *authImpl) GetUserAuthInfo(user string) (*cbauthimpl.UserAuthInfo, Creds, error) {
+	info, creds, err := cbauthimpl.GetUserAuthInfo(a.svc, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, creds, nil
+}
+
 func (a *authImpl) GetMemcachedServiceAuth(hostport string) (user, pwd string, err error) {
 	host, port, err := SplitHostPort(hostport)
 	if err != nil {
@@ -1,12 +1,21 @@
 package cbauth
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/rpc"
+	"net/rpc/jsonrpc"
 	"reflect"
 	"strings"
 	"sync"
@@ -772,13 +781,14 @@ func TestStaleErrorFormatting(t *testing.T) {
 	}))
 	defer s.Close()
 
-	oldDef := revrpc.DefaultBabysitErrorPolicy.(revrpc.DefaultErrorPolicy)
+	oldPolicy := restartPolicy
 	defer func() {
-		revrpc.DefaultBabysitErrorPolicy = oldDef
+		restartPolicy = oldPolicy
 	}()
-	tmpDef := oldDef
-	tmpDef.RestartsToExit = 1
-	revrpc.DefaultBabysitErrorPolicy = tmpDef
+	restartPolicy = revrpc.BackoffErrorPolicy{
+		InitialBackoff: time.Millisecond,
+		RestartsToExit: 1,
+	}
 
 	commonPrefix := "CBAuth database is stale: last reason: "
 	notFoundErr := commonPrefix + "Need 200 status!. Got 404"
@@ -793,7 +803,7 @@ func CheckStaleErrorFormatting(t *testing.T, URL string, expectedErrorPrefix str
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		runRPCForSvc(rpcsvc, a.svc, getCbauthErrorPolicy(a.svc, false))
+		runRPCForSvc(rpcsvc, a.svc, getCbauthErrorPolicy(rpcsvc, a.svc, false))
 		wg.Done()
 	}()
 
@@ -809,3 +819,472 @@ func CheckStaleErrorFormatting(t *testing.T, URL string, expectedErrorPrefix str
 	}
 	wg.Wait()
 }
+
+type rtFunc func(req *http.Request) (*http.Response, error)
+
+func (f rtFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSpecialPasswordsRotation(t *testing.T) {
+	a := newAuth(0)
+	a.setTransport(rtFunc(func(req *http.Request) (*http.Response, error) {
+		user, pwd, _ := req.BasicAuth()
+		if user != "@cbauth" || pwd != "old" {
+			return respond(req, 401, ""), nil
+		}
+		return respond(req, 200, `{"uuid": "abcd"}`), nil
+	}))
+
+	cache := newCache(a)
+	cache.SpecialUser = "@cbauth"
+	cache.SpecialPasswords = []string{"new", "old"}
+	must(a.svc.UpdateDB(cache, nil))
+
+	uuid, err := a.GetUserUuid("user", "local")
+	must(err)
+	assertEqual(t, "uuid", "abcd", uuid)
+
+	var stats cbauthimpl.CachesStats
+	must(a.svc.GetStats(nil, &stats))
+	expected := cbauthimpl.RotationStats{
+		Rejected:     1,
+		Retries:      1,
+		RetrySuccess: 1,
+	}
+	if stats.RotationStats != expected {
+		t.Fatalf("Unexpected rotation stats: %+v", stats.RotationStats)
+	}
+}
+
+func TestWrapHTTPTransportRetriesAfterUpdate(t *testing.T) {
+	a := newAuth(0)
+	cache := cbauthimpl.Cache{
+		Nodes: []cbauthimpl.Node{
+			mkNode("beta.local", "_admin", "old", []int{9000}, false)},
+		SpecialUser: "@component",
+	}
+	must(a.svc.UpdateDB(&cache, nil))
+
+	rejected := make(chan struct{}, 1)
+	var bodies []string
+	rt := WrapHTTPTransport(rtFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		must(err)
+		bodies = append(bodies, string(body))
+
+		user, pwd, _ := req.BasicAuth()
+		if user != "@component" || pwd != "new" {
+			rejected <- struct{}{}
+			return respond(req, 401, ""), nil
+		}
+		return respond(req, 200, ""), nil
+	}), a)
+
+	go func() {
+		<-rejected
+		cache.Nodes[0].Password = "new"
+		must(a.svc.UpdateDB(&cache, nil))
+	}()
+
+	req, err := http.NewRequest("POST", "http://beta.local:9000/_test",
+		strings.NewReader("payload"))
+	must(err)
+	resp, err := rt.RoundTrip(req)
+	must(err)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected request to succeed. Got: %v", resp.Status)
+	}
+	if !reflect.DeepEqual(bodies, []string{"payload", "payload"}) {
+		t.Fatalf("Unexpected request bodies: %v", bodies)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Fatalf("Original request must not be modified")
+	}
+
+	stats := cbauthimpl.GetRotationStats(a.svc)
+	if stats.UpdateWaits != 1 || stats.RetrySuccess != 1 {
+		t.Fatalf("Unexpected rotation stats: %+v", stats)
+	}
+}
+
+func TestWrapHTTPTransportWaitHonorsContext(t *testing.T) {
+	a := newAuth(0)
+	cache := cbauthimpl.Cache{
+		Nodes: []cbauthimpl.Node{
+			mkNode("beta.local", "_admin", "old", []int{9000}, false)},
+		SpecialUser: "@component",
+	}
+	must(a.svc.UpdateDB(&cache, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := WrapHTTPTransport(rtFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return respond(req, 401, ""), nil
+	}), a)
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"http://beta.local:9000/_test", nil)
+	must(err)
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	must(err)
+	if resp.StatusCode != 401 {
+		t.Fatalf("Expected 401. Got: %v", resp.Status)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Wait for rotation ignored request context")
+	}
+}
+
+func TestRotationWaitReleasesSemaphore(t *testing.T) {
+	a := newAuth(0)
+	a.setTransport(rtFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("user") == "good" {
+			return respond(req, 200, `{"uuid": "abcd"}`), nil
+		}
+		return respond(req, 401, ""), nil
+	}))
+
+	cache := newCache(a)
+	cache.SpecialUser = "@cbauth"
+	cache.SpecialPasswords = []string{"pwd"}
+	must(a.svc.UpdateDB(cache, nil))
+
+	// more rejected requests than there are semaphore slots
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a.GetUserUuid(fmt.Sprintf("bad%d", i), "local")
+		}(i)
+	}
+	for cbauthimpl.GetRotationStats(a.svc).UpdateWaits != 20 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	uuid, err := a.GetUserUuid("good", "local")
+	must(err)
+	assertEqual(t, "uuid", "abcd", uuid)
+	if time.Since(start) > time.Second {
+		t.Fatalf("Request was stalled by requests waiting for rotation")
+	}
+
+	must(a.svc.UpdateDB(cache, nil))
+	wg.Wait()
+}
+
+func TestClusterTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pwd, _ := r.BasicAuth()
+		if user != "@component" || pwd != "pwd" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.TLS != nil {
+			w.Write([]byte("tls"))
+		} else {
+			w.Write([]byte("plain"))
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	encrypted := httptest.NewTLSServer(handler)
+	defer encrypted.Close()
+
+	_, plainPort, err := SplitHostPort(strings.TrimPrefix(plain.URL, "http://"))
+	must(err)
+	_, tlsPort, err := SplitHostPort(strings.TrimPrefix(encrypted.URL, "https://"))
+	must(err)
+	// service that has no TLS port
+	other := httptest.NewServer(handler)
+	defer other.Close()
+	_, otherPort, err := SplitHostPort(strings.TrimPrefix(other.URL, "http://"))
+	must(err)
+
+	node := mkNode("127.0.0.1", "_admin", "pwd",
+		[]int{plainPort, tlsPort, otherPort}, true)
+	node.TLSPorts = map[int]int{plainPort: tlsPort}
+	ca := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: encrypted.Certificate().Raw,
+	})
+	cache := cbauthimpl.Cache{
+		Nodes:       []cbauthimpl.Node{node},
+		SpecialUser: "@component",
+		CACerts:     string(ca),
+	}
+
+	a := newAuth(0)
+	must(a.svc.UpdateDB(&cache, nil))
+
+	rt, err := NewClusterTransport(a, nil)
+	must(err)
+	client := &http.Client{Transport: rt}
+	defer client.CloseIdleConnections()
+
+	get := func() string {
+		resp, err := client.Get(plain.URL + "/test")
+		must(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		must(err)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Unexpected response: %s", resp.Status)
+		}
+		return string(body)
+	}
+
+	assertEqual(t, "response", "plain", get())
+
+	cache.ClusterEncryptionConfig.EncryptData = true
+	must(a.svc.UpdateDB(&cache, nil))
+	assertEqual(t, "response", "tls", get())
+
+	_, err = client.Get(other.URL + "/test")
+	if !errors.Is(err, ErrNoTLSPort) {
+		t.Fatalf("Expected ErrNoTLSPort. Got: %v", err)
+	}
+
+	cache.ClusterEncryptionConfig.EncryptData = false
+	must(a.svc.UpdateDB(&cache, nil))
+	assertEqual(t, "response", "plain", get())
+}
+
+func TestClusterTransportUnsupportedAuthenticator(t *testing.T) {
+	type otherAuth struct{ Authenticator }
+	_, err := NewClusterTransport(otherAuth{}, nil)
+	if err != ErrUnsupportedAuthenticator {
+		t.Fatalf("Expected ErrUnsupportedAuthenticator. Got: %v", err)
+	}
+}
+
+func TestGetUserAuthInfo(t *testing.T) {
+	a := newAuth(0)
+	requests := 0
+	a.setTransport(rtFunc(func(req *http.Request) (*http.Response, error) {
+		requests++
+		if req.URL.Path != "/_authInfo" {
+			return respond(req, 404, ""), nil
+		}
+		if req.URL.Query().Get("user") != "alice" {
+			return respond(req, 404, ""), nil
+		}
+		return respond(req, 200, `{"user": "alice", "domain": "local",
+			"scram-sha-256": {"salt": "c2FsdA==", "iterations": 10,
+			"storedKey": "AAEC", "serverKey": "AwQF"}}`), nil
+	}))
+
+	cache := newCache(a)
+	cache.AuthInfoURL = "http://127.0.0.1:9000/_authInfo"
+	cache.AuthVersion = "1"
+	must(a.svc.UpdateDB(cache, nil))
+
+	for i := 0; i < 2; i++ {
+		info, creds, err := a.GetUserAuthInfo("alice")
+		must(err)
+		if creds.Name() != "alice" || creds.Domain() != "local" {
+			t.Fatalf("Unexpected creds: %v", creds)
+		}
+		if info.ScramSha512 != nil || info.ScramSha256 == nil ||
+			string(info.ScramSha256.Salt) != "salt" ||
+			info.ScramSha256.Iterations != 10 ||
+			!bytes.Equal(info.ScramSha256.StoredKey, []byte{0, 1, 2}) {
+			t.Fatalf("Unexpected auth info: %+v", info)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Expected auth info to be cached. Got %d requests", requests)
+	}
+
+	_, _, err := a.GetUserAuthInfo("bob")
+	if err != ErrUserNotFound {
+		t.Fatalf("Expected ErrUserNotFound. Got %v", err)
+	}
+}
+
+func TestStaleErrorConnectionLost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		conn.Close()
+	}()
+
+	rpcsvc := revrpc.MustService("http://" + l.Addr().String() + "/test")
+	a := newAuth(10 * time.Second)
+	// external policy gives up on io.EOF
+	runRPCForSvc(rpcsvc, a.svc, getCbauthErrorPolicy(rpcsvc, a.svc, true))
+
+	_, err = a.Auth("", "")
+	se, ok := err.(*DBStaleError)
+	if !ok || !se.WasConnected || se.Err != io.EOF {
+		t.Fatalf("Expected stale error for lost connection. Got: %v", err)
+	}
+	if !strings.HasSuffix(se.Error(), "(connection to ns_server was lost)") {
+		t.Fatalf("Unexpected error message: %s", se.Error())
+	}
+
+	se = newStaleError(revrpc.MustService("http://127.0.0.1:1/test"), io.EOF)
+	if se.WasConnected ||
+		!strings.HasSuffix(se.Error(), "(never connected to ns_server)") {
+		t.Fatalf("Unexpected error message: %s", se.Error())
+	}
+}
+
+// fakeNsServer accepts revrpc connections and returns url to connect
+// to and channel of rpc clients for accepted connections.
+func fakeNsServer(t *testing.T) (string, chan *rpc.Client) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	t.Cleanup(func() { l.Close() })
+	clients := make(chan *rpc.Client, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			r := bufio.NewReader(conn)
+			if _, err := http.ReadRequest(r); err != nil {
+				conn.Close()
+				continue
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			clients <- jsonrpc.NewClient(struct {
+				io.Reader
+				io.WriteCloser
+			}{r, conn})
+		}
+	}()
+	return "http://user:pwd@" + l.Addr().String() + "/cbauth", clients
+}
+
+func TestNew(t *testing.T) {
+	_, _, err := New(&Options{Revrpc: &revrpc.ServiceOptions{
+		Getenv: func(string) string { return "" }}})
+	if err == nil {
+		t.Fatalf("Expected error without CBAUTH_REVRPC_URL")
+	}
+
+	// two independent instances in the same process
+	var auths []Authenticator
+	var closers []io.Closer
+	for _, pwd := range []string{"foo", "bar"} {
+		url, clients := fakeNsServer(t)
+		a, c, err := New(&Options{
+			Service:         revrpc.MustService(url),
+			WaitBeforeStale: time.Minute,
+		})
+		must(err)
+		auths = append(auths, a)
+		closers = append(closers, c)
+
+		var client *rpc.Client
+		select {
+		case client = <-clients:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Authenticator didn't connect")
+		}
+		cache := cbauthimpl.Cache{
+			Nodes: append(cbauthimpl.Cache{}.Nodes,
+				mkNode("beta.local", "_admin", pwd, []int{9000}, false)),
+		}
+		var ok bool
+		must(client.Call("AuthCacheSvc.UpdateDB", &cache, &ok))
+	}
+
+	for i, pwd := range []string{"foo", "bar"} {
+		_, p, err := auths[i].GetMemcachedServiceAuth("beta.local:9000")
+		if err != nil || p != pwd {
+			t.Fatalf("Expected password %s. Got %s, %v", pwd, p, err)
+		}
+	}
+
+	must(closers[0].Close())
+	must(closers[0].Close())
+	_, _, err = auths[0].GetMemcachedServiceAuth("beta.local:9000")
+	if se, ok := err.(*DBStaleError); !ok || se.Err != ErrClosed {
+		t.Fatalf("Expected stale error after Close. Got %v", err)
+	}
+	if _, p, _ := auths[1].GetMemcachedServiceAuth("beta.local:9000"); p != "bar" {
+		t.Fatalf("Closing one authenticator affected the other")
+	}
+	must(closers[1].Close())
+}
+
+func TestNewCloseInterruptsRestartSleep(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	sleeping := make(chan struct{}, 1)
+	oldPolicy := restartPolicy
+	defer func() {
+		restartPolicy = oldPolicy
+	}()
+	restartPolicy = revrpc.BackoffErrorPolicy{
+		InitialBackoff: time.Hour,
+		Int63n:         func(n int64) int64 { return n - 1 },
+		LogPrint: func(args ...interface{}) {
+			select {
+			case sleeping <- struct{}{}:
+			default:
+			}
+		},
+	}
+
+	_, c, err := New(&Options{Service: revrpc.MustService(s.URL + "/test")})
+	must(err)
+	<-sleeping
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close waited for restart sleep")
+	}
+}
+
+func TestResetDefaultForTest(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+	defer ResetDefaultForTest()
+
+	t.Setenv("CBAUTH_REVRPC_URL", "")
+	ResetDefaultForTest()
+	if err := WithDefault(func(Authenticator) error { return nil }); err == nil {
+		t.Fatalf("Expected error without CBAUTH_REVRPC_URL")
+	}
+
+	t.Setenv("CBAUTH_REVRPC_URL", s.URL+"/test")
+	ResetDefaultForTest()
+	if Default != nil {
+		t.Fatalf("Default was created before first use after reset")
+	}
+	a := GetDefault()
+	if a == nil || Default != a {
+		t.Fatalf("Default wasn't created again: %v", ErrNotInitialized)
+	}
+	if GetDefault() != a {
+		t.Fatalf("Default was created twice")
+	}
+
+	ResetDefaultForTest()
+	if Default != nil {
+		t.Fatalf("Default wasn't forgotten")
+	}
+	_, _, err := a.GetMemcachedServiceAuth("beta.local:9000")
+	if se, ok := err.(*DBStaleError); !ok || se.Err != ErrClosed {
+		t.Fatalf("Expected old Default to be closed. Got %v", err)
+	}
+}
@@ -19,6 +19,7 @@ package cbauthimpl
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"crypto/x509"
@@ -33,9 +34,11 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/cbauth/httpreq"
+	"github.com/couchbase/cbauth/logging"
 	"github.com/couchbase/cbauth/utils"
 )
 
@@ -115,6 +118,10 @@ var ErrCallbackAlreadyRegistered = errors.New("Certificate refresh callback is a
 // ErrUserNotFound is used to signal when username can't be extracted from client certificate.
 var ErrUserNotFound = errors.New("Username not found")
 
+// ErrUnknownHostPort is used to signal that given host and port don't
+// belong to any service known to cbauth.
+var ErrUnknownHostPort = errors.New("Unknown host and port")
+
 const uaCbauthSuffix = "cbauth"
 const uaCbauthVersion = ""
 
@@ -128,6 +135,9 @@ type Node struct {
 	Password string
 	Ports    []int
 	Local    bool
+	// TLSPorts maps plain ports of node's services to ports of
+	// their TLS counterparts.
+	TLSPorts map[int]int
 }
 
 func matchHost(n Node, host string) bool {
@@ -167,6 +177,7 @@ type credsDB struct {
 	permissionCheckURL      string
 	uuidCheckURL            string
 	userBucketsURL          string
+	authInfoURL             string
 	specialUser             string
 	specialPasswords        []string
 	permissionsVersion      string
@@ -178,6 +189,7 @@ type credsDB struct {
 	clientCertAuthVersion   string
 	clusterEncryptionConfig ClusterEncryptionConfig
 	tlsConfig               TLSConfig
+	caCerts                 string
 	lastHeard               time.Time
 	cacheConfig             CacheConfig
 }
@@ -189,6 +201,7 @@ type Cache struct {
 	PermissionCheckURL      string `json:"permissionCheckUrl"`
 	UuidCheckURL            string
 	UserBucketsURL          string
+	AuthInfoURL             string   `json:"authInfoUrl"`
 	SpecialUser             string   `json:"specialUser"`
 	SpecialPasswords        []string `json:"specialPasswords"`
 	PermissionsVersion      string
@@ -202,6 +215,7 @@ type Cache struct {
 	ClusterEncryptionConfig ClusterEncryptionConfig `json:"clusterEncryptionConfig"`
 	TLSConfig               tlsConfigImport         `json:"tlsConfig"`
 	CacheConfig             CacheConfig             `json:"cacheConfig"`
+	CACerts                 string                  `json:"caCerts"`
 }
 
 // Cache is a structure into which the revrpc json is unmarshalled if
@@ -228,6 +242,16 @@ type CredsImpl struct {
 	s        *Svc
 }
 
+// RotationStats describes how often outgoing requests had their
+// credentials rejected and were retried with rotated passwords.
+type RotationStats struct {
+	Rejected     uint64 `json:"rejected"`
+	Retries      uint64 `json:"retries"`
+	UpdateWaits  uint64 `json:"updateWaits"`
+	RetrySuccess uint64 `json:"retrySuccess"`
+	RetryFailure uint64 `json:"retryFailure"`
+}
+
 type CacheStats struct {
 	Name    string `json:"name"`
 	MaxSize int    `json:"maxSize"`
@@ -356,6 +380,8 @@ func (n *cfgChangeNotifier) loop() {
 			continue
 		}
 
+		logging.Error("cbauth: config refresh callback failed",
+			"changes", changes, "err", err)
 		if retry == nil {
 			retry = time.After(5 * time.Second)
 		}
@@ -436,6 +462,7 @@ func (n *tlsNotifier) loop() {
 			continue
 		}
 
+		logging.Error("cbauth: TLS refresh callback failed", "err", err)
 		if retry == nil {
 			retry = time.After(5 * time.Second)
 		}
@@ -448,9 +475,12 @@ type Svc struct {
 	db                  *credsDB
 	staleErr            error
 	freshChan           chan struct{}
+	updateChan          chan struct{}
+	rotationStats       RotationStats
 	uuidCache           ReqCache
 	userBktsCache       ReqCache
 	upCache             ReqCache
+	authInfoCache       ReqCache
 	authCache           *utils.Cache
 	authCacheOnce       sync.Once
 	clientCertCache     *utils.Cache
@@ -459,6 +489,7 @@ type Svc struct {
 	semaphore           semaphore
 	tlsNotifier         *tlsNotifier
 	cfgChangeNotifier   *cfgChangeNotifier
+	cfgVersion          uint64
 	hostport            string
 	user                string
 	password            string
@@ -481,6 +512,7 @@ func cacheToCredsDB(c *Cache) (db *credsDB) {
 		permissionCheckURL:      c.PermissionCheckURL,
 		uuidCheckURL:            c.UuidCheckURL,
 		userBucketsURL:          c.UserBucketsURL,
+		authInfoURL:             c.AuthInfoURL,
 		specialUser:             c.SpecialUser,
 		specialPasswords:        c.SpecialPasswords,
 		permissionsVersion:      c.PermissionsVersion,
@@ -493,6 +525,7 @@ func cacheToCredsDB(c *Cache) (db *credsDB) {
 		clusterEncryptionConfig: c.ClusterEncryptionConfig,
 		tlsConfig:               importTLSConfig(&c.TLSConfig, c.ClientCertAuthState),
 		cacheConfig:             c.CacheConfig,
+		caCerts:                 c.CACerts,
 	}
 	return
 }
@@ -524,6 +557,8 @@ func updateDBLocked(s *Svc, db *credsDB) {
 		close(s.freshChan)
 		s.freshChan = nil
 	}
+	close(s.updateChan)
+	s.updateChan = make(chan struct{})
 }
 
 // UpdateDBExt is a revrpc method that is used by ns_server update external
@@ -536,6 +571,9 @@ func (s *Svc) UpdateDBExt(c *CacheExt, outparam *bool) error {
 	s.l.Lock()
 	updateDBLocked(s, db)
 	s.l.Unlock()
+	logging.Debug("cbauth: db updated",
+		"permissionsVersion", c.PermissionsVersion,
+		"authVersion", c.AuthVersion)
 	return nil
 }
 
@@ -565,6 +603,9 @@ func updateCacheSize(s *Svc, db *credsDB) {
 		if s.upCache.cache != nil {
 			s.upCache.cache.UpdateSize(db.cacheConfig.UpCacheSize)
 		}
+		if s.authInfoCache.cache != nil {
+			s.authInfoCache.cache.UpdateSize(db.cacheConfig.AuthCacheSize)
+		}
 		if s.authCache != nil {
 			s.authCache.UpdateSize(db.cacheConfig.AuthCacheSize)
 		}
@@ -587,7 +628,12 @@ func (s *Svc) UpdateDB(c *Cache, outparam *bool) error {
 	updateCacheSize(s, db)
 	updateDBLocked(s, db)
 	s.l.Unlock()
+	logging.Debug("cbauth: db updated",
+		"permissionsVersion", c.PermissionsVersion,
+		"authVersion", c.AuthVersion, "userVersion", c.UserVersion)
 	if cfgChanges != 0 {
+		logging.Info("cbauth: config changed", "changes", cfgChanges)
+		atomic.AddUint64(&s.cfgVersion, 1)
 		s.tlsNotifier.notifyTLSChange()
 		s.cfgChangeNotifier.notifyCfgChange(cfgChanges)
 	}
@@ -595,7 +641,8 @@ func (s *Svc) UpdateDB(c *Cache, outparam *bool) error {
 }
 
 type CachesStats struct {
-	CacheStats []CacheStats `json:"cacheStats"`
+	CacheStats    []CacheStats  `json:"cacheStats"`
+	RotationStats RotationStats `json:"rotationStats"`
 }
 
 func (s *Svc) GetStats(Void, outparam *CachesStats) error {
@@ -615,6 +662,9 @@ func (s *Svc) GetStats(Void, outparam *CachesStats) error {
 	stats = getCacheStats("up_cache", s.upCache.cache)
 	cacheStats = append(cacheStats, *stats)
 
+	stats = getCacheStats("auth_info_cache", s.authInfoCache.cache)
+	cacheStats = append(cacheStats, *stats)
+
 	stats = getCacheStats("auth_cache", s.authCache)
 	cacheStats = append(cacheStats, *stats)
 
@@ -622,6 +672,7 @@ func (s *Svc) GetStats(Void, outparam *CachesStats) error {
 	cacheStats = append(cacheStats, *stats)
 
 	(*outparam).CacheStats = cacheStats
+	(*outparam).RotationStats = GetRotationStats(s)
 
 	return nil
 }
@@ -635,9 +686,12 @@ func ResetSvc(s *Svc, staleErr error) {
 	s.staleErr = staleErr
 	updateDBLocked(s, nil)
 	s.l.Unlock()
+	logging.Warn("cbauth: db is stale", "err", staleErr)
 }
 
 func staleError(s *Svc) error {
+	s.l.RLock()
+	defer s.l.RUnlock()
 	if s.db != nil {
 		return errors.New("Didn't hear from server for a while")
 	}
@@ -664,6 +718,7 @@ func NewSVCForTest(period time.Duration, staleErr error, waitfn func(time.Durati
 
 	s := &Svc{
 		staleErr:          staleErr,
+		updateChan:        make(chan struct{}),
 		semaphore:         make(semaphore, 10),
 		tlsNotifier:       newTLSNotifier(),
 		cfgChangeNotifier: newCfgChangeNotifier(),
@@ -716,7 +771,18 @@ func (s *Svc) SetConnectInfo(hostport, user, password string,
 	s.heartbeatWait = heartbeatWait
 }
 
+// SetHostPort changes ns_server host:port that is used to build urls
+// of REST endpoints, e.g. when revrpc connection fails over to another
+// node.
+func (s *Svc) SetHostPort(hostport string) {
+	s.l.Lock()
+	s.hostport = hostport
+	s.l.Unlock()
+}
+
 func (s *Svc) buildUrl(uri string) string {
+	s.l.RLock()
+	defer s.l.RUnlock()
 	return "http://" + s.hostport + uri
 }
 
@@ -743,6 +809,7 @@ func (s *Svc) needConfigRefresh(db *credsDB) uint64 {
 
 func (s *Svc) serverTLSSettingsChanged(db *credsDB) bool {
 	return s.db.certVersion != db.certVersion ||
+		s.db.caCerts != db.caCerts ||
 		s.db.tlsConfig.MinVersion != db.tlsConfig.MinVersion ||
 		!reflect.DeepEqual(s.db.tlsConfig.CipherSuites,
 			db.tlsConfig.CipherSuites) ||
@@ -844,7 +911,7 @@ func VerifyOnServer(s *Svc, reqHeaders httpreq.HttpHeader) (*CredsImpl, error) {
 		return nil, staleError(s)
 	}
 
-	if s.db.authCheckURL == "" {
+	if db.authCheckURL == "" {
 		return nil, ErrNoAuth
 	}
 
@@ -926,12 +993,13 @@ type ReqParams struct {
 	domain       string
 	service      string
 	permission   string
+	// noRetry disables retries with rotated special passwords for
+	// endpoints where 401 is a legitimate answer rather than a sign
+	// of rejected creds.
+	noRetry bool
 }
 
 func getFromServer(s *Svc, db *credsDB, params *ReqParams) (interface{}, error) {
-	s.semaphore.wait()
-	defer s.semaphore.signal()
-
 	req, err := http.NewRequest("GET", params.url, nil)
 	if err != nil {
 		return nil, err
@@ -939,10 +1007,6 @@ func getFromServer(s *Svc, db *credsDB, params *ReqParams) (interface{}, error)
 
 	req.Header.Set("User-Agent", userAgent)
 
-	if len(db.specialPasswords) > 0 {
-		req.SetBasicAuth(db.specialUser, db.specialPasswords[0])
-	}
-
 	v := url.Values{}
 	v.Set("user", params.user)
 	v.Set("domain", params.domain)
@@ -954,9 +1018,31 @@ func getFromServer(s *Svc, db *credsDB, params *ReqParams) (interface{}, error)
 	}
 	req.URL.RawQuery = v.Encode()
 
+	if len(db.specialPasswords) == 0 {
+		s.semaphore.wait()
+		defer s.semaphore.signal()
+		val, _, err := doGetFromServer(s, req, params)
+		return val, err
+	}
+
+	var val interface{}
+	_, err = s.withSpecialCreds(db, func(user, pwd string) (bool, error) {
+		req.SetBasicAuth(user, pwd)
+		var rejected bool
+		val, rejected, err = doGetFromServer(s, req, params)
+		if params.noRetry {
+			rejected = false
+		}
+		return rejected, err
+	})
+	return val, err
+}
+
+func doGetFromServer(s *Svc, req *http.Request,
+	params *ReqParams) (interface{}, bool, error) {
 	hresp, err := s.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	defer hresp.Body.Close()
@@ -964,7 +1050,7 @@ func getFromServer(s *Svc, db *credsDB, params *ReqParams) (interface{}, error)
 
 	val, err := params.respCallback(hresp)
 
-	return val, err
+	return val, hresp.StatusCode == 401, err
 }
 
 // GET response callback for GetUserUuid
@@ -1148,6 +1234,7 @@ func checkPermission(s *Svc, user, domain, permission string) (bool, error) {
 		user:         user,
 		domain:       domain,
 		permission:   permission,
+		noRetry:      true,
 	}
 
 	var cacheParams *CacheParams
@@ -1175,6 +1262,92 @@ func checkPermission(s *Svc, user, domain, permission string) (bool, error) {
 	return allowed, err
 }
 
+// ScramInfo is SCRAM-SHA verification data of the user as defined by
+// RFC 5802. It allows to verify SCRAM proofs without knowing the
+// password.
+type ScramInfo struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	StoredKey  []byte `json:"storedKey"`
+	ServerKey  []byte `json:"serverKey"`
+}
+
+// UserAuthInfo is credentials data of the user that ns_server returns
+// from authInfoUrl. Data for some of SCRAM-SHA mechanisms might be
+// missing.
+type UserAuthInfo struct {
+	User        string     `json:"user"`
+	Domain      string     `json:"domain"`
+	ScramSha512 *ScramInfo `json:"scram-sha-512"`
+	ScramSha256 *ScramInfo `json:"scram-sha-256"`
+	ScramSha1   *ScramInfo `json:"scram-sha-1"`
+}
+
+type userAuthInfo struct {
+	version string
+	user    string
+}
+
+// GET response callback for GetUserAuthInfo
+func processResponseAuthInfo(resp *http.Response) (interface{}, error) {
+	switch resp.StatusCode {
+	case 200:
+		body, readErr := ioutil.ReadAll(resp.Body)
+		if readErr != nil {
+			return nil, fmt.Errorf("Unexpected readErr %v", readErr)
+		}
+		info := &UserAuthInfo{}
+		jsonErr := json.Unmarshal(body, info)
+		if jsonErr != nil {
+			return nil, fmt.Errorf("Unexpected json unmarshal error %v", jsonErr)
+		}
+		return info, nil
+	case 404:
+		return nil, ErrUserNotFound
+	}
+
+	return nil, fmt.Errorf("Unexpected return code %v", resp.StatusCode)
+}
+
+// GetUserAuthInfo returns credentials data of given local user
+// together with Creds that represent the user. Creds must only be
+// handed out after the user proves knowledge of the password. Returns
+// ErrUserNotFound if the user is not known.
+func GetUserAuthInfo(s *Svc, user string) (*UserAuthInfo, *CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, nil, staleError(s)
+	}
+	if db.authInfoURL == "" {
+		return nil, nil, ErrUserNotFound
+	}
+
+	reqParams := &ReqParams{
+		respCallback: processResponseAuthInfo,
+		url:          db.authInfoURL,
+		user:         user,
+		domain:       "local",
+	}
+
+	cacheSize := db.cacheConfig.AuthCacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultAuthCacheSize
+	}
+
+	cacheParams := &CacheParams{
+		cache: &s.authInfoCache,
+		key:   userAuthInfo{db.authVersion, user},
+		size:  cacheSize,
+	}
+
+	val, err := handleGetRequest(s, db, reqParams, cacheParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := val.(*UserAuthInfo)
+	return info, &CredsImpl{name: info.User, domain: info.Domain, s: s}, nil
+}
+
 type userPassword struct {
 	version  string
 	user     string
@@ -1251,6 +1424,169 @@ func GetCreds(s *Svc, host string, port int) (memcachedUser, user, pwd string, e
 	return
 }
 
+// waitForRotation is how long a request whose creds were rejected
+// waits for ns_server to deliver rotated passwords via UpdateDB.
+const waitForRotation = 5 * time.Second
+
+// credsFn returns user and candidate passwords for some destination
+// according to given db. Passwords are tried in order.
+type credsFn func(db *credsDB) (user string, pwds []string, err error)
+
+// credsBody performs request using given creds. It returns true if the
+// creds were rejected by the other side.
+type credsBody func(user, pwd string) (rejected bool, err error)
+
+// withRotatedCreds calls body with creds returned by getCreds. When the
+// creds are rejected, body is retried with the rest of candidate
+// passwords. Once those are exhausted we wait for the next UpdateDB (as
+// ns_server might have rotated passwords that we haven't seen yet) and
+// retry once with passwords from updated db. The wait is skipped if db
+// was already replaced since the request started, and is cut short
+// when ctx is done. Returns result of last body invocation.
+func (s *Svc) withRotatedCreds(ctx context.Context, db *credsDB,
+	getCreds credsFn, body credsBody) (rejected bool, err error) {
+	tried := make(map[string]bool)
+	for waited := false; ; waited = true {
+		user, pwds, credsErr := getCreds(db)
+		if credsErr != nil {
+			return false, credsErr
+		}
+		for _, pwd := range pwds {
+			if tried[user+"\x00"+pwd] {
+				continue
+			}
+			if len(tried) != 0 {
+				atomic.AddUint64(&s.rotationStats.Retries, 1)
+			}
+			tried[user+"\x00"+pwd] = true
+
+			rejected, err = body(user, pwd)
+			if !rejected {
+				if len(tried) > 1 && err == nil {
+					atomic.AddUint64(
+						&s.rotationStats.RetrySuccess, 1)
+				}
+				return false, err
+			}
+			if len(tried) == 1 {
+				atomic.AddUint64(&s.rotationStats.Rejected, 1)
+			}
+		}
+
+		if waited || len(tried) == 0 {
+			break
+		}
+
+		atomic.AddUint64(&s.rotationStats.UpdateWaits, 1)
+		if !s.waitForUpdate(ctx, db, waitForRotation) {
+			break
+		}
+		db = fetchDB(s)
+		if db == nil {
+			return rejected, staleError(s)
+		}
+	}
+
+	if len(tried) > 1 {
+		atomic.AddUint64(&s.rotationStats.RetryFailure, 1)
+	}
+	return rejected, err
+}
+
+// withSpecialCreds is withRotatedCreds for requests to ns_server that
+// are authenticated by special user. Body is called with the request
+// semaphore held, but the semaphore is released while waiting for
+// rotated passwords, so that rejected requests don't stall the rest.
+func (s *Svc) withSpecialCreds(db *credsDB, body credsBody) (bool, error) {
+	return s.withRotatedCreds(context.Background(), db,
+		func(db *credsDB) (string, []string, error) {
+			return db.specialUser, db.specialPasswords, nil
+		},
+		func(user, pwd string) (bool, error) {
+			s.semaphore.wait()
+			defer s.semaphore.signal()
+			return body(user, pwd)
+		})
+}
+
+// waitForUpdate waits until db gets replaced by UpdateDB or ResetSvc,
+// but not longer than timeout or until ctx is done. Returns true right
+// away if db is already replaced and false on timeout or cancellation.
+func (s *Svc) waitForUpdate(ctx context.Context, db *credsDB,
+	timeout time.Duration) bool {
+	s.l.RLock()
+	current := s.db
+	ch := s.updateChan
+	s.l.RUnlock()
+
+	if current != db {
+		return true
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-ch:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func getServiceCreds(db *credsDB, host string, port int,
+	memcached bool) (user string, pwds []string, err error) {
+	for _, n := range db.nodes {
+		memcachedUser, pwd := getMemcachedCreds(n, host, port)
+		if memcachedUser == "" {
+			continue
+		}
+		user = db.specialUser
+		if memcached {
+			user = memcachedUser
+		}
+		pwds = []string{pwd}
+		if n.Local {
+			pwds = append(pwds, db.specialPasswords...)
+		}
+		return user, pwds, nil
+	}
+	return "", nil, ErrUnknownHostPort
+}
+
+// DoWithServiceCreds calls body with creds for service at given host
+// and port. Memcached admin creds are used if memcached is true, and
+// http special user otherwise. If body reports that the creds were
+// rejected, it is retried with other passwords of the node, and then,
+// after next UpdateDB, with rotated passwords. Waiting for UpdateDB
+// stops when ctx is done. ErrUnknownHostPort is returned if host/port
+// represents unknown service.
+func DoWithServiceCreds(ctx context.Context, s *Svc, host string, port int,
+	memcached bool,
+	body func(user, pwd string) (rejected bool, err error)) (bool, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return false, staleError(s)
+	}
+	return s.withRotatedCreds(ctx, db, func(db *credsDB) (string, []string, error) {
+		return getServiceCreds(db, host, port, memcached)
+	}, body)
+}
+
+// GetRotationStats returns counters of retries caused by rejected
+// creds.
+func GetRotationStats(s *Svc) RotationStats {
+	return RotationStats{
+		Rejected:     atomic.LoadUint64(&s.rotationStats.Rejected),
+		Retries:      atomic.LoadUint64(&s.rotationStats.Retries),
+		UpdateWaits:  atomic.LoadUint64(&s.rotationStats.UpdateWaits),
+		RetrySuccess: atomic.LoadUint64(&s.rotationStats.RetrySuccess),
+		RetryFailure: atomic.LoadUint64(&s.rotationStats.RetryFailure),
+	}
+}
+
 // RegisterTLSRefreshCallback registers callback for refreshing TLS config
 func RegisterTLSRefreshCallback(s *Svc, callback TLSRefreshCallback) error {
 	return s.tlsNotifier.registerCallback(callback)
@@ -1283,6 +1619,46 @@ func GetClusterEncryptionConfig(s *Svc) (ClusterEncryptionConfig, error) {
 	return db.clusterEncryptionConfig, nil
 }
 
+// GetConfigVersion returns a number that changes every time certificates,
+// TLS config or cluster encryption config change.
+func GetConfigVersion(s *Svc) uint64 {
+	return atomic.LoadUint64(&s.cfgVersion)
+}
+
+// GetTLSPort returns TLS port that corresponds to given plain port of
+// service at given host. Returns 0 if the service has no known TLS
+// counterpart and ErrUnknownHostPort if host/port represents unknown
+// service.
+func GetTLSPort(s *Svc, host string, port int) (int, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return 0, staleError(s)
+	}
+	for _, n := range db.nodes {
+		if user, _ := getMemcachedCreds(n, host, port); user != "" {
+			return n.TLSPorts[port], nil
+		}
+	}
+	return 0, ErrUnknownHostPort
+}
+
+// GetClusterCAPool returns pool of cluster CA certificates. Returns nil
+// pool if ns_server didn't send any CA certificates.
+func GetClusterCAPool(s *Svc) (*x509.CertPool, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	if db.caCerts == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(db.caCerts)) {
+		return nil, fmt.Errorf("No valid CA certificates found")
+	}
+	return pool, nil
+}
+
 func importTLSConfig(cfg *tlsConfigImport, ClientCertAuthState string) TLSConfig {
 	return TLSConfig{
 		MinVersion:                 minTLSVersion(cfg.MinTLSVersion),
@@ -1406,21 +1782,37 @@ func getUserIdentityFromCert(cert *x509.Certificate, db *credsDB, s *Svc) (*Cred
 		return nil, ErrNoAuth
 	}
 
-	s.semaphore.wait()
-	defer s.semaphore.signal()
-
-	req, err := http.NewRequest("POST", db.extractUserFromCertURL, bytes.NewReader(cert.Raw))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Content-Type", "application/octet-stream")
-	if len(db.specialPasswords) > 0 {
-		req.SetBasicAuth(db.specialUser, db.specialPasswords[0])
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", db.extractUserFromCertURL,
+			bytes.NewReader(cert.Raw))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/octet-stream")
+		req.Header.Set("User-Agent", userAgent)
+		return req, nil
 	}
 
-	req.Header.Set("User-Agent", userAgent)
+	if len(db.specialPasswords) == 0 {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		s.semaphore.wait()
+		defer s.semaphore.signal()
+		return executeReqAndGetCreds(s, req)
+	}
 
-	rv, err := executeReqAndGetCreds(s, req)
+	var rv *CredsImpl
+	_, err := s.withSpecialCreds(db, func(user, pwd string) (bool, error) {
+		req, err := newReq()
+		if err != nil {
+			return false, err
+		}
+		req.SetBasicAuth(user, pwd)
+		rv, err = executeReqAndGetCreds(s, req)
+		return err == ErrNoAuth, err
+	})
 	if err != nil {
 		return nil, err
 	}
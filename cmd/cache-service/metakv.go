@@ -15,40 +15,36 @@
 package main
 
 import (
-	"encoding/json"
-
 	"github.com/couchbase/cbauth/metakv"
 	log "github.com/couchbase/clog"
 )
 
-func MetakvGet(path string, v interface{}) bool {
-	raw, _, err := metakv.Get(path)
+func MetakvGet[T any](path string, v *T) bool {
+	value, _, err := metakv.GetJSON[T](path)
 	if err != nil {
 		log.Fatalf("Failed to fetch %s from metakv: %s", path, err.Error())
 	}
 
-	if raw == nil {
+	if value == nil {
 		return false
 	}
 
-	err = json.Unmarshal(raw, v)
-	if err != nil {
-		log.Fatalf("Failed unmarshalling value for %s: %s\n%s",
-			path, err.Error(), string(raw))
-	}
-
+	*v = *value
 	return true
 }
 
-func MetakvSet(path string, v interface{}) {
-	raw, err := json.Marshal(v)
+func MetakvSet[T any](path string, v T) {
+	err := metakv.SetJSON(path, v, nil)
 	if err != nil {
-		log.Fatalf("Failed to marshal value for %s: %s\n%v",
-			path, err.Error(), v)
+		log.Fatalf("Failed to set %s: %s", path, err.Error())
 	}
+}
 
-	err = metakv.Set(path, raw, nil)
+func MetakvUpdate[T any](path string, fn func(old *T) *T) {
+	err := metakv.Update(path, func(old *T) (*T, error) {
+		return fn(old), nil
+	})
 	if err != nil {
-		log.Fatalf("Failed to set %s: %s", path, err.Error())
+		log.Fatalf("Failed to update %s: %s", path, err.Error())
 	}
 }
@@ -34,10 +34,12 @@ func InitNode(node service.NodeID, host string) {
 }
 
 func SetNodeHostName(node service.NodeID, host string) {
-	currentHost := GetNodeHostName(node)
-	if host != currentHost {
-		MetakvSet(hostPath(node), host)
-	}
+	MetakvUpdate(hostPath(node), func(currentHost *string) *string {
+		if currentHost != nil && *currentHost == host {
+			return nil
+		}
+		return &host
+	})
 }
 
 func GetNodeHostName(node service.NodeID) string {
@@ -56,25 +56,35 @@ type TokenMap struct {
 	Tokens  TokenList
 }
 
-func (tm TokenMap) save() {
-	MetakvSet(TokensKey, tm)
-}
-
 func MaybeCreateInitialTokenMap() {
-	tm := &TokenMap{}
-	if MetakvGet(TokensKey, tm) {
-		return
-	}
-
-	log.Printf("No token map found. Creating initial one.")
+	MetakvUpdate(TokensKey, func(old *TokenMap) *TokenMap {
+		if old != nil {
+			return nil
+		}
 
-	tm.Servers = []service.NodeID{}
-	tm.Tokens = TokenList{}
+		log.Printf("No token map found. Creating initial one.")
 
-	tm.save()
+		return &TokenMap{
+			Servers: []service.NodeID{},
+			Tokens:  TokenList{},
+		}
+	})
 }
 
+// UpdateServers stores token map with given servers. Tokens are
+// recomputed from the token map that is currently in metakv, so that
+// concurrent changes to it are not overwritten; tm is only used if
+// there's none.
 func (tm TokenMap) UpdateServers(newServers []service.NodeID) {
+	MetakvUpdate(TokensKey, func(old *TokenMap) *TokenMap {
+		if old == nil {
+			old = &tm
+		}
+		return old.withServers(newServers)
+	})
+}
+
+func (tm TokenMap) withServers(newServers []service.NodeID) *TokenMap {
 	removed := serversMap(tm.Servers)
 	added := serversMap(newServers)
 
@@ -103,7 +113,7 @@ func (tm TokenMap) UpdateServers(newServers []service.NodeID) {
 	tm.Tokens = newTokens
 
 	sort.Sort(tm.Tokens)
-	tm.save()
+	return &tm
 }
 
 func (tm TokenMap) FindOwner(key string) service.NodeID {
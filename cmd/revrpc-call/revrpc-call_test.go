@@ -0,0 +1,88 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/revrpc"
+)
+
+type Echo struct{}
+
+func (Echo) Echo(arg *map[string]int, reply *map[string]int) error {
+	*reply = *arg
+	return nil
+}
+
+func TestCallWithHeartbeatsAndOutboundCalls(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	svc := revrpc.MustService("http://user:pwd@" + l.Addr().String() + "/test-svc")
+	svc.SetHeartbeat(10 * time.Millisecond)
+	svc.SetIdleTimeout(time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.RunContext(ctx, func(s *rpc.Server) error {
+			return s.RegisterName("Test", Echo{})
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client, err := accept(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// a few heartbeats go by
+	time.Sleep(50 * time.Millisecond)
+
+	err = svc.Call(context.Background(), "Foo.Bar", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Foo.Bar") {
+		t.Fatalf("Expected outbound call to fail. Got %v", err)
+	}
+
+	var out bytes.Buffer
+	err = call(&out, client, "Test.Echo", `{"a": 1}`)
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if got := strings.Join(strings.Fields(out.String()), ""); got != `{"a":1}` {
+		t.Fatalf("Unexpected reply %q", out.String())
+	}
+
+	if err := call(&out, client, "Test.Echo", `{`); err == nil {
+		t.Fatalf("Expected invalid args to be rejected")
+	}
+	if svc.State() != revrpc.StateConnected {
+		t.Fatalf("Service lost connection: %v", svc.State())
+	}
+}
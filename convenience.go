@@ -16,9 +16,12 @@
 package cbauth
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"net/http"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
 )
 
 // SetRequestAuthVia sets basic auth header in given http request
@@ -63,22 +66,102 @@ func dupRequest(req *http.Request) *http.Request {
 	return &rv
 }
 
+// withServiceAuth calls body with creds giving "admin" access to service
+// at given hostport. If body reports that the creds were rejected and
+// authenticator is capable of it, body is retried with rotated service
+// passwords. Waiting for rotated passwords stops when ctx is done.
+func withServiceAuth(ctx context.Context, a Authenticator, hostport string,
+	memcached bool,
+	body func(user, pwd string) (rejected bool, err error)) error {
+	impl, ok := a.(*authImpl)
+	if !ok {
+		var user, pwd string
+		var err error
+		if memcached {
+			user, pwd, err = a.GetMemcachedServiceAuth(hostport)
+		} else {
+			user, pwd, err = a.GetHTTPServiceAuth(hostport)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = body(user, pwd)
+		return err
+	}
+
+	host, port, err := SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	_, err = cbauthimpl.DoWithServiceCreds(ctx, impl.svc, host, port,
+		memcached, body)
+	if err == cbauthimpl.ErrUnknownHostPort {
+		return UnknownHostPortError(hostport)
+	}
+	return err
+}
+
 type cbauthRoundTripper struct {
 	slave http.RoundTripper
 	a     Authenticator
 }
 
 func (rt *cbauthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	req = dupRequest(req)
-	if err := SetRequestAuthVia(req, rt.a); err != nil {
+	var resp *http.Response
+	err := WithAuthenticator(rt.a, func(a Authenticator) error {
+		return withServiceAuth(req.Context(), a, req.URL.Host, false,
+			func(user, pwd string) (bool, error) {
+				r := dupRequest(req)
+				if resp != nil {
+					// request body was consumed by previous
+					// attempt, so we can only retry if it
+					// can be recreated
+					if r.Body != nil && r.Body != http.NoBody {
+						if r.GetBody == nil {
+							return false, nil
+						}
+						body, err := r.GetBody()
+						if err != nil {
+							return false, nil
+						}
+						r.Body = body
+					}
+					resp.Body.Close()
+					resp = nil
+				}
+				r.SetBasicAuth(user, pwd)
+
+				var err error
+				resp, err = rt.slave.RoundTrip(r)
+				if err != nil {
+					return false, err
+				}
+				return resp.StatusCode == http.StatusUnauthorized, nil
+			})
+	})
+	if err != nil {
 		return nil, err
 	}
-	return rt.slave.RoundTrip(req)
+	return resp, nil
+}
+
+// CloseIdleConnections closes idle connections of wrapped transport if
+// it supports that.
+func (rt *cbauthRoundTripper) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := rt.slave.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
 }
 
 // WrapHTTPTransport constructs http transport that automatically does
-// SetRequestAuthVia for requests it sends. As usual, if nil
-// authenticator is passed, default authenticator is used.
+// SetRequestAuthVia for requests it sends. If destination rejects
+// credentials with 401, the request is retried with rotated service
+// passwords (provided request body can be obtained again via
+// GetBody). As usual, if nil authenticator is passed, default
+// authenticator is used.
 func WrapHTTPTransport(transport http.RoundTripper, a Authenticator) http.RoundTripper {
 	return &cbauthRoundTripper{
 		slave: transport,
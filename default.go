@@ -16,6 +16,7 @@
 package cbauth
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -25,6 +26,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -34,11 +36,56 @@ import (
 )
 
 // Default variable holds default authenticator. Default authenticator
-// is constructed automatically from environment variables passed by
-// ns_server. It is nil if your process was not (correctly) spawned by
-// ns_server.
+// is constructed automatically (by New) from environment variables
+// passed by ns_server. It is nil if your process was not (correctly)
+// spawned by ns_server. Authenticators independent of Default can be
+// created with New.
 var Default Authenticator
 
+var (
+	defaultL      sync.Mutex
+	defaultTried  bool
+	defaultCloser io.Closer
+)
+
+func init() {
+	GetDefault()
+}
+
+// GetDefault returns Default authenticator, creating it if this
+// wasn't done yet (i.e. after ResetDefaultForTest). It returns nil if
+// cbauth cannot be initialized from environment, in which case
+// ErrNotInitialized describes why.
+func GetDefault() Authenticator {
+	defaultL.Lock()
+	defer defaultL.Unlock()
+	return getDefaultLocked()
+}
+
+func getDefaultLocked() Authenticator {
+	if Default != nil || defaultTried {
+		return Default
+	}
+	defaultTried = true
+	rpcsvc, err := revrpc.GetDefaultServiceFromEnv("cbauth")
+	if err == nil {
+		err = setDefaultLocked(rpcsvc)
+	}
+	if err != nil {
+		ErrNotInitialized = fmt.Errorf("Unable to initialize cbauth's revrpc: %s", err)
+	}
+	return Default
+}
+
+func setDefaultLocked(rpcsvc *revrpc.Service) error {
+	a, c, err := New(&Options{Service: rpcsvc})
+	if err != nil {
+		return err
+	}
+	Default, defaultCloser = a, c
+	return nil
+}
+
 type restartableAuthImpl struct {
 	l sync.RWMutex
 	a ExternalAuthenticator
@@ -82,85 +129,206 @@ var errUnrecoverable = errors.New("revrpc connection cannot be established")
 
 const waitBeforeStale = time.Minute
 
-func getCbauthErrorPolicy(svc *cbauthimpl.Svc,
-	external bool) revrpc.ErrorPolicyFn {
+func newStaleError(rpcsvc *revrpc.Service, err error) *DBStaleError {
+	return &DBStaleError{
+		Err:          err,
+		WasConnected: rpcsvc.Stats().Connects > 0,
+	}
+}
 
-	if external {
-		defPolicy := getCbauthErrorPolicy(svc, false)
+// restartPolicy decides when revrpc service of cbauth is restarted.
+// Backoff with jitter keeps processes that lost ns_server at the same
+// time from reconnecting in lockstep.
+var restartPolicy = revrpc.BackoffBabysitErrorPolicy
+
+// cbauthErrorPolicy marks cbauth db stale right after every error of
+// revrpc service and then delegates restart decision to restartPolicy.
+// For external cbauth closed connection and unsupported protocol
+// version are final.
+type cbauthErrorPolicy struct {
+	rpcsvc   *revrpc.Service
+	svc      *cbauthimpl.Svc
+	external bool
+}
+
+func getCbauthErrorPolicy(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc,
+	external bool) revrpc.BabysitErrorPolicy {
+	return cbauthErrorPolicy{rpcsvc: rpcsvc, svc: svc, external: external}
+}
+
+func (p cbauthErrorPolicy) New() revrpc.ErrorPolicyFn {
+	return p.NewForService(context.Background(), p.rpcsvc)
+}
+
+func (p cbauthErrorPolicy) NewForService(ctx context.Context,
+	s *revrpc.Service) revrpc.ErrorPolicyFn {
+	rpcsvc, svc := p.rpcsvc, p.svc
+	if p.external {
+		defPolicy := cbauthErrorPolicy{rpcsvc: rpcsvc, svc: svc}.
+			NewForService(ctx, s)
+		// with several endpoints closed connection means that we
+		// should fail over to another node
+		failover := len(rpcsvc.Endpoints()) > 1
 		return func(err error) error {
-			if err == io.EOF {
-				cbauthimpl.ResetSvc(svc, &DBStaleError{err})
+			if err == io.EOF && !failover {
+				cbauthimpl.ResetSvc(svc, newStaleError(rpcsvc, err))
 				return errDisconnected
 			}
-			httpErr, ok := err.(*revrpc.HttpError)
-			if ok &&
-				httpErr.StatusCode == 400 &&
-				httpErr.Message == "Version is not supported" {
-				cbauthimpl.ResetSvc(svc, &DBStaleError{err})
+			if revrpc.IsVersionNotSupported(err) {
+				cbauthimpl.ResetSvc(svc, newStaleError(rpcsvc, err))
 				return errUnrecoverable
 			}
 			return defPolicy(err)
 		}
-	} else {
-		defPolicy := revrpc.DefaultBabysitErrorPolicy.New()
-		// error restart policy that we're going to use simply
-		// resets service before delegating to default restart
-		// policy. That way we always mark service as stale
-		// right after some error occurred.
-		return func(err error) error {
-			cbauthimpl.ResetSvc(svc, &DBStaleError{err})
-			return defPolicy(err)
-		}
+	}
+
+	defPolicy := revrpc.NewErrorPolicyFn(restartPolicy, ctx, s)
+	// error restart policy that we're going to use simply
+	// resets service before delegating to default restart
+	// policy. That way we always mark service as stale
+	// right after some error occurred.
+	return func(err error) error {
+		cbauthimpl.ResetSvc(svc, newStaleError(rpcsvc, err))
+		return defPolicy(err)
 	}
 }
 
-func runRPCForSvc(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc,
-	policy revrpc.ErrorPolicyFn) error {
-	return revrpc.BabysitService(func(s *rpc.Server) error {
+func setupForSvc(svc *cbauthimpl.Svc) revrpc.ServiceSetupCallback {
+	return func(s *rpc.Server) error {
 		return s.RegisterName("AuthCacheSvc", svc)
-	}, rpcsvc, revrpc.FnBabysitErrorPolicy(policy))
+	}
 }
 
-func startDefault(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc,
-	policy revrpc.ErrorPolicyFn, external bool) {
-	if external {
-		externalAuth.setAuth(&authImpl{svc}, rpcsvc)
-	} else {
-		Default = &authImpl{svc}
-	}
+func runRPCForSvc(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc,
+	policy revrpc.BabysitErrorPolicy) error {
+	return revrpc.BabysitService(setupForSvc(svc), rpcsvc, policy)
+}
+
+func startExternal(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc,
+	policy revrpc.BabysitErrorPolicy) {
+	externalAuth.setAuth(&authImpl{svc}, rpcsvc)
 	go func() {
 		err := runRPCForSvc(rpcsvc, svc, policy)
 		if errors.Is(err, errDisconnected) ||
-			errors.Is(err, errUnrecoverable) {
+			errors.Is(err, errUnrecoverable) ||
+			rpcsvc.State() == revrpc.StateStopped {
 			return
 		}
 		panic(err)
 	}()
 }
 
-func init() {
-	rpcsvc, err := revrpc.GetDefaultServiceFromEnv("cbauth")
-	if err != nil {
-		ErrNotInitialized = fmt.Errorf("Unable to initialize cbauth's revrpc: %s", err)
-		return
+func newSvc() *cbauthimpl.Svc {
+	return cbauthimpl.NewSVC(waitBeforeStale, &DBStaleError{})
+}
+
+// ResetDefaultForTest closes Default authenticator and forgets it, so
+// that tests can initialize it again (from environment on next use of
+// package level functions, or with InternalRetryDefaultInit). Closed authenticator returns
+// DBStaleError from then on. It's meant for tests only.
+func ResetDefaultForTest() {
+	defaultL.Lock()
+	defer defaultL.Unlock()
+	if defaultCloser != nil {
+		defaultCloser.Close()
+		defaultCloser = nil
 	}
-	svc := newSvc()
-	startDefault(rpcsvc, svc, getCbauthErrorPolicy(svc, false), false)
+	Default = nil
+	defaultTried = false
+	ErrNotInitialized = errNotInitialized
+	revrpc.ResetDefaultServicesForTest()
 }
 
-func newSvc() *cbauthimpl.Svc {
-	return cbauthimpl.NewSVC(waitBeforeStale, &DBStaleError{})
+// ErrClosed is returned (wrapped into DBStaleError) by authenticator
+// created by New after it was closed.
+var ErrClosed = errors.New("cbauth authenticator was closed")
+
+// Options configures authenticator created by New. Zero values mean
+// defaults.
+type Options struct {
+	// Name is name of revrpc service. Default is "cbauth".
+	Name string
+	// Revrpc configures revrpc service obtained from environment.
+	Revrpc *revrpc.ServiceOptions
+	// Service, if set, is used instead of revrpc service obtained
+	// from environment.
+	Service *revrpc.Service
+	// WaitBeforeStale is initial period during which authenticator
+	// waits for ns_server to send the db instead of returning
+	// DBStaleError. Default is one minute.
+	WaitBeforeStale time.Duration
+}
+
+type closer struct {
+	once   sync.Once
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Close stops revrpc service of the authenticator and waits until it's
+// stopped. It returns error if service failed for other reasons before
+// that.
+func (c *closer) Close() error {
+	c.once.Do(c.cancel)
+	<-c.done
+	return c.err
+}
+
+// New creates independent authenticator that is served by its own
+// revrpc service, unlike Default, which is a process-wide singleton.
+// Returned io.Closer stops the service, after which authenticator
+// returns DBStaleError. opts may be nil.
+func New(opts *Options) (Authenticator, io.Closer, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	rpcsvc := opts.Service
+	if rpcsvc == nil {
+		name := opts.Name
+		if name == "" {
+			name = "cbauth"
+		}
+		var err error
+		rpcsvc, err = revrpc.NewServiceFromEnv(name, opts.Revrpc)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	wait := opts.WaitBeforeStale
+	if wait == 0 {
+		wait = waitBeforeStale
+	}
+
+	svc := cbauthimpl.NewSVC(wait, &DBStaleError{})
+	policy := getCbauthErrorPolicy(rpcsvc, svc, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &closer{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		err := revrpc.BabysitServiceContext(ctx, setupForSvc(svc), rpcsvc,
+			policy)
+		if err != context.Canceled {
+			c.err = err
+		}
+		cbauthimpl.ResetSvc(svc, newStaleError(rpcsvc, ErrClosed))
+	}()
+	return &authImpl{svc}, c, nil
 }
 
 // InitExternal should be used by external cbauth client to enable cbauth
-// with limited functionality.
+// with limited functionality. mgmtHostPort may be comma separated list
+// of management addresses of cluster nodes, in which case cbauth
+// fails over to the next node when it cannot connect to the current
+// one.
 func InitExternal(service, mgmtHostPort, user, password string) error {
 	return InitExternalWithHeartbeat(service, mgmtHostPort, user, password,
 		0, 0)
 }
 
 // InitExternalWithHeartbeat should be used by external cbauth client to enable
-// cbauth with limited functionality and enabling heartbeats.
+// cbauth with limited functionality and enabling heartbeats. See
+// InitExternal for the format of mgmtHostPort.
 // heartbeatInterval - interval in seconds at which heartbeats should be sent
 // heartbeatWait - defines how many seconds we wait until declaring the
 // database stale
@@ -192,7 +360,9 @@ func InternalRetryDefaultInit(mgmtHostPort, user, password string) (bool, error)
 // really needed. Returns false if Default Authenticator was already
 // initialized.
 func InternalRetryDefaultInitWithService(service, mgmtHostPort, user, password string) (bool, error) {
-	if Default != nil {
+	defaultL.Lock()
+	defer defaultL.Unlock()
+	if getDefaultLocked() != nil {
 		return false, nil
 	}
 	return doInternalRetryDefaultInitWithService(service+"-cbauth",
@@ -202,33 +372,53 @@ func InternalRetryDefaultInitWithService(service, mgmtHostPort, user, password s
 func doInternalRetryDefaultInitWithService(
 	service, mgmtHostPort, user, password string,
 	external bool, heartbeatInterval, heartbeatWait int) (bool, error) {
-	host, port, err := SplitHostPort(mgmtHostPort)
-	if err != nil {
-		return false, fmt.Errorf("Failed to split hostport `%s': %s", mgmtHostPort, err)
-	}
-	var baseurl string
-	if external {
-		baseurl = fmt.Sprintf("http://%s:%d/auth/v1/%s",
-			host, port, service)
-	} else {
-		baseurl = fmt.Sprintf("http://%s:%d/%s", host, port, service)
-	}
-	if heartbeatInterval != 0 {
-		baseurl = baseurl + fmt.Sprintf("?heartbeat=%v",
-			heartbeatInterval)
+	hostPorts := strings.Split(mgmtHostPort, ",")
+	urls := make([]string, len(hostPorts))
+	for i, hostPort := range hostPorts {
+		hostPort = strings.TrimSpace(hostPort)
+		hostPorts[i] = hostPort
+		host, port, err := SplitHostPort(hostPort)
+		if err != nil {
+			return false, fmt.Errorf("Failed to split hostport `%s': %s", hostPort, err)
+		}
+		var baseurl string
+		if external {
+			baseurl = fmt.Sprintf("http://%s:%d/auth/v1/%s",
+				host, port, service)
+		} else {
+			baseurl = fmt.Sprintf("http://%s:%d/%s", host, port, service)
+		}
+		if heartbeatInterval != 0 {
+			baseurl = baseurl + fmt.Sprintf("?heartbeat=%v",
+				heartbeatInterval)
+		}
+		u, err := url.Parse(baseurl)
+		if err != nil {
+			return false, fmt.Errorf("Failed to parse constructed url `%s': %s", baseurl, err)
+		}
+		u.User = url.UserPassword(user, password)
+		urls[i] = u.String()
 	}
-	u, err := url.Parse(baseurl)
+
+	rpcsvc, err := revrpc.NewServiceWithEndpoints(urls)
 	if err != nil {
-		return false, fmt.Errorf("Failed to parse constructed url `%s': %s", baseurl, err)
+		return false, err
+	}
+	if !external {
+		err = setDefaultLocked(rpcsvc)
+		return err == nil, err
 	}
-	u.User = url.UserPassword(user, password)
 
 	svc := newSvc()
-	svc.SetConnectInfo(mgmtHostPort, user, password, heartbeatInterval,
+	svc.SetConnectInfo(hostPorts[0], user, password, heartbeatInterval,
 		heartbeatWait)
-
-	startDefault(revrpc.MustService(u.String()), svc,
-		getCbauthErrorPolicy(svc, external), external)
+	// REST calls should go to the node we're connected to
+	rpcsvc.Subscribe(func(c revrpc.StateChange) {
+		if c.To == revrpc.StateConnected {
+			svc.SetHostPort(rpcsvc.ActiveEndpoint().Host)
+		}
+	})
+	startExternal(rpcsvc, svc, getCbauthErrorPolicy(rpcsvc, svc, true))
 
 	return true, nil
 }
@@ -236,7 +426,9 @@ func doInternalRetryDefaultInitWithService(
 // ErrNotInitialized is used to signal that ns_server environment
 // variables are not set, and thus Default authenticator is not
 // configured for calls that use default authenticator.
-var ErrNotInitialized = errors.New("cbauth was not initialized")
+var ErrNotInitialized = errNotInitialized
+
+var errNotInitialized = errors.New("cbauth was not initialized")
 
 // WithDefault calls given body with default authenticator. If default
 // authenticator is not configured, it returns ErrNotInitialized.
@@ -249,7 +441,7 @@ func WithDefault(body func(a Authenticator) error) error {
 // returned if a is nil and default authenticator is not configured.
 func WithAuthenticator(a Authenticator, body func(a Authenticator) error) error {
 	if a == nil {
-		a = Default
+		a = GetDefault()
 		if a == nil {
 			return ErrNotInitialized
 		}
@@ -264,104 +456,116 @@ func GetExternalAuthenticator() ExternalAuthenticator {
 // AuthWebCreds method extracts credentials from given http request
 // using default authenticator.
 func AuthWebCreds(req *http.Request) (creds Creds, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return nil, ErrNotInitialized
 	}
-	return Default.AuthWebCreds(req)
+	return a.AuthWebCreds(req)
 }
 
 // AuthWebCredsGeneric method extracts credentials from an HTTP request
 // that is generic (not necessarily using the net/http library)
 func AuthWebCredsGeneric(req httpreq.HttpRequest) (creds Creds, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return nil, ErrNotInitialized
 	}
-	return Default.AuthWebCredsGeneric(req)
+	return a.AuthWebCredsGeneric(req)
 }
 
 // Auth method constructs credentials from given user and password
 // pair. Uses default authenticator.
 func Auth(user, pwd string) (creds Creds, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return nil, ErrNotInitialized
 	}
-	return Default.Auth(user, pwd)
+	return a.Auth(user, pwd)
 }
 
 // GetHTTPServiceAuth returns user/password creds giving "admin"
 // access to given http service inside couchbase cluster. Uses default
 // authenticator.
 func GetHTTPServiceAuth(hostport string) (user, pwd string, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return "", "", ErrNotInitialized
 	}
-	return Default.GetHTTPServiceAuth(hostport)
+	return a.GetHTTPServiceAuth(hostport)
 }
 
 // GetMemcachedServiceAuth returns user/password creds given "admin"
 // access to given memcached service. Uses default authenticator.
 func GetMemcachedServiceAuth(hostport string) (user, pwd string, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return "", "", ErrNotInitialized
 	}
-	return Default.GetMemcachedServiceAuth(hostport)
+	return a.GetMemcachedServiceAuth(hostport)
 }
 
 // RegisterTLSRefreshCallback registers a callback to be called when any field
 // of TLS settings change. The callback is called in separate routine
 func RegisterTLSRefreshCallback(callback TLSRefreshCallback) error {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return ErrNotInitialized
 	}
-	Default.RegisterTLSRefreshCallback(callback)
+	a.RegisterTLSRefreshCallback(callback)
 	return nil
 }
 
 func RegisterConfigRefreshCallback(callback ConfigRefreshCallback) error {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return ErrNotInitialized
 	}
-	Default.RegisterConfigRefreshCallback(callback)
+	a.RegisterConfigRefreshCallback(callback)
 	return nil
 }
 
 // GetClientCertAuthType returns TLS cert type
 func GetClientCertAuthType() (tls.ClientAuthType, error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return tls.NoClientCert, ErrNotInitialized
 	}
-	return Default.GetClientCertAuthType()
+	return a.GetClientCertAuthType()
 }
 
 func GetClusterEncryptionConfig() (ClusterEncryptionConfig, error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return ClusterEncryptionConfig{}, ErrNotInitialized
 	}
 
-	return Default.GetClusterEncryptionConfig()
+	return a.GetClusterEncryptionConfig()
 }
 
 func GetUserUuid(user, domain string) (string, error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return "", ErrNotInitialized
 	}
 
-	return Default.GetUserUuid(user, domain)
+	return a.GetUserUuid(user, domain)
 }
 
 func GetUserBuckets(user, domain string) ([]string, error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return []string{}, ErrNotInitialized
 	}
 
-	return Default.GetUserBuckets(user, domain)
+	return a.GetUserBuckets(user, domain)
 }
 
 // GetTLSConfig returns current tls config that contains cipher suites,
 // min TLS version, etc.
 func GetTLSConfig() (TLSConfig, error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return TLSConfig{}, ErrNotInitialized
 	}
-	return Default.GetTLSConfig()
+	return a.GetTLSConfig()
 }
@@ -0,0 +1,58 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/couchbase/clog"
+)
+
+type clogLogger struct{}
+
+// NewClogLogger returns Logger that logs via github.com/couchbase/clog.
+// Key/value pairs are appended to the message as key=value.
+func NewClogLogger() Logger {
+	return clogLogger{}
+}
+
+func formatKV(msg string, kv []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 == len(kv) {
+			fmt.Fprintf(&b, " !BADKEY=%v", kv[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	return b.String()
+}
+
+func (clogLogger) Log(level Level, msg string, kv ...interface{}) {
+	s := formatKV(msg, kv)
+	switch level {
+	case LevelDebug:
+		log.Debugf("%s", s)
+	case LevelWarn:
+		log.Warnf("%s", s)
+	case LevelError:
+		log.Errorf("%s", s)
+	default:
+		log.Printf("%s", s)
+	}
+}
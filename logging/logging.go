@@ -0,0 +1,166 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging is the logger used by revrpc, cbauth and metakv. By
+// default everything is logged via github.com/couchbase/clog. Process
+// can route the logs elsewhere by calling SetLogger once, e.g. with
+// NewSlogLogger. Credentials in urls are redacted from all messages and
+// values.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is severity of log record.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Logger receives log records. kv are alternating keys and values
+// that describe the record.
+type Logger interface {
+	Log(level Level, msg string, kv ...interface{})
+}
+
+// ErrAlreadySet is returned by SetLogger when logger was already set.
+var ErrAlreadySet = errors.New("logger was already set")
+
+type holder struct {
+	Logger
+}
+
+var (
+	current atomic.Value
+	setL    sync.Mutex
+	set     bool
+)
+
+func init() {
+	current.Store(holder{NewClogLogger()})
+}
+
+// SetLogger sets logger for the whole process. It can be called only
+// once, subsequent calls return ErrAlreadySet. nil logger disables
+// logging.
+func SetLogger(logger Logger) error {
+	setL.Lock()
+	defer setL.Unlock()
+	if set {
+		return ErrAlreadySet
+	}
+	set = true
+	current.Store(holder{logger})
+	return nil
+}
+
+func logRecord(level Level, msg string, kv []interface{}) {
+	logger := current.Load().(holder).Logger
+	if logger == nil {
+		return
+	}
+	redacted := make([]interface{}, len(kv))
+	for i, v := range kv {
+		if i%2 == 0 {
+			redacted[i] = v
+		} else {
+			redacted[i] = redact(v)
+		}
+	}
+	logger.Log(level, RedactURLs(msg), redacted...)
+}
+
+// Debug logs debug message with given key/value pairs.
+func Debug(msg string, kv ...interface{}) {
+	logRecord(LevelDebug, msg, kv)
+}
+
+// Info logs informational message with given key/value pairs.
+func Info(msg string, kv ...interface{}) {
+	logRecord(LevelInfo, msg, kv)
+}
+
+// Warn logs warning with given key/value pairs.
+func Warn(msg string, kv ...interface{}) {
+	logRecord(LevelWarn, msg, kv)
+}
+
+// Error logs error with given key/value pairs.
+func Error(msg string, kv ...interface{}) {
+	logRecord(LevelError, msg, kv)
+}
+
+// PrintFunc returns function that logs its arguments at given level
+// in fmt.Sprint fashion. It suits LogPrint fields and arguments of
+// revrpc.
+func PrintFunc(level Level) func(args ...interface{}) {
+	return func(args ...interface{}) {
+		logRecord(level, fmt.Sprint(args...), nil)
+	}
+}
+
+var urlCredsRe = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*):[^/\s@]*@`)
+
+// RedactURLs replaces passwords of all urls in given string with
+// "xxxxx".
+func RedactURLs(s string) string {
+	return urlCredsRe.ReplaceAllString(s, "${1}:xxxxx@")
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return RedactURLs(v)
+	case *url.URL:
+		if v == nil {
+			return v
+		}
+		return v.Redacted()
+	case url.URL:
+		return v.Redacted()
+	case error:
+		if v == nil {
+			return v
+		}
+		return RedactURLs(v.Error())
+	case fmt.Stringer:
+		return RedactURLs(v.String())
+	}
+	return v
+}
@@ -0,0 +1,51 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns Logger that logs to given slog.Logger, or to
+// slog.Default() if it's nil.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return slogLogger{l}
+}
+
+func (s slogLogger) Log(level Level, msg string, kv ...interface{}) {
+	var lvl slog.Level
+	switch level {
+	case LevelDebug:
+		lvl = slog.LevelDebug
+	case LevelWarn:
+		lvl = slog.LevelWarn
+	case LevelError:
+		lvl = slog.LevelError
+	default:
+		lvl = slog.LevelInfo
+	}
+	s.l.Log(context.Background(), lvl, msg, kv...)
+}
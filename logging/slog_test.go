@@ -0,0 +1,42 @@
+//go:build go1.21
+
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	resetLogger(t)
+
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	if err := SetLogger(NewSlogLogger(slog.New(h))); err != nil {
+		t.Fatal(err)
+	}
+
+	Debug("connecting", "url", "http://u:p@h/")
+	Error("failed", "attempt", 2)
+
+	expected := `level=DEBUG msg=connecting url=http://u:xxxxx@h/
+level=ERROR msg=failed attempt=2
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s",
+			buf.String(), expected)
+	}
+	if !strings.Contains(buf.String(), "xxxxx") {
+		t.Fatalf("Expected url to be redacted")
+	}
+}
@@ -16,10 +16,17 @@
 package cbauth
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
 	couchbase "github.com/couchbase/go-couchbase"
+	"github.com/couchbase/gomemcached"
 	"github.com/couchbase/gomemcached/client"
+	"github.com/couchbase/goutils/scramsha"
 )
 
 // AuthHandler is a type that implements go-couchbase AuthHandler,
@@ -27,12 +34,107 @@ import (
 // cbauth into go-couchbase.
 type AuthHandler struct {
 	Bucket string
-	A      Authenticator
+	// Scope and Collection, if set, define collection context of
+	// memcached connections.
+	Scope      string
+	Collection string
+	A          Authenticator
+	// Features lists HELLO features to negotiate on memcached
+	// connections. FeatureCollections is always requested if
+	// collection context is set.
+	Features memcached.Features
+	// AllowPlain permits falling back to PLAIN SASL mechanism if
+	// memcached doesn't offer any of SCRAM-SHA mechanisms. Note that
+	// PLAIN sends password in clear text unless connection is
+	// encrypted.
+	AllowPlain bool
+
+	conns *authedConns
 }
 
 var _ couchbase.MultiBucketAuthHandler = (*AuthHandler)(nil)
 var _ couchbase.HTTPAuthHandler = (*AuthHandler)(nil)
 
+// FeatureDuplex is HELLO feature that gomemcached doesn't have name
+// for. JSON is memcached.FeatureDataType.
+const FeatureDuplex = memcached.Feature(0x0c)
+
+// MemcachedConnInfo describes what was set up on memcached connection
+// by AuthHandler.
+type MemcachedConnInfo struct {
+	// Features negotiated via HELLO.
+	Features     memcached.Features
+	Bucket       string
+	Scope        string
+	Collection   string
+	CollectionID uint32
+}
+
+// HasFeature returns true if given feature was negotiated.
+func (i *MemcachedConnInfo) HasFeature(feature memcached.Feature) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientContext returns memcached.ClientContext that directs requests
+// to the collection of the connection.
+func (i *MemcachedConnInfo) ClientContext() *memcached.ClientContext {
+	return &memcached.ClientContext{CollId: i.CollectionID}
+}
+
+// maxAuthedConns bounds how many connections AuthHandler (with its
+// copies) remembers. Connections that don't fit are reauthenticated
+// on every ReauthenticateMemcachedConn call.
+var maxAuthedConns = 4096
+
+type authedConn struct {
+	pwd  string
+	info MemcachedConnInfo
+}
+
+// authedConns remembers passwords that memcached connections were
+// authenticated with. So that we're able to tell which connections
+// need to be reauthenticated after password rotation.
+type authedConns struct {
+	l     sync.Mutex
+	conns map[*memcached.Client]authedConn
+}
+
+func (c *authedConns) add(conn *memcached.Client, ac authedConn) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if _, ok := c.conns[conn]; !ok && len(c.conns) >= maxAuthedConns {
+		// connections that went bad are going to be dropped by
+		// their pools, so they can be forgotten to make room
+		for other := range c.conns {
+			if !other.IsHealthy() {
+				delete(c.conns, other)
+			}
+		}
+		if len(c.conns) >= maxAuthedConns {
+			return
+		}
+	}
+	c.conns[conn] = ac
+}
+
+func (c *authedConns) get(conn *memcached.Client) (authedConn, bool) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	ac, ok := c.conns[conn]
+	return ac, ok
+}
+
+func (c *authedConns) forget(conn *memcached.Client) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	delete(c.conns, conn)
+}
+
 // GetCredentials method returns empty creds (it is not supposed to be
 // used in practice).
 func (ah *AuthHandler) GetCredentials() (string, string, string) {
@@ -44,9 +146,101 @@ func (ah *AuthHandler) GetCredentials() (string, string, string) {
 func (ah *AuthHandler) ForBucket(bucket string) couchbase.AuthHandler {
 	copy := *ah
 	copy.Bucket = bucket
+	copy.Scope = ""
+	copy.Collection = ""
+	return &copy
+}
+
+// ForScope method returns copy of AuthHandler that is configured for
+// given scope of its bucket.
+func (ah *AuthHandler) ForScope(scope string) *AuthHandler {
+	copy := *ah
+	copy.Scope = scope
+	copy.Collection = ""
+	return &copy
+}
+
+// ForCollection method returns copy of AuthHandler that is configured
+// for given collection of its bucket.
+func (ah *AuthHandler) ForCollection(scope, collection string) *AuthHandler {
+	copy := *ah
+	copy.Scope = scope
+	copy.Collection = collection
 	return &copy
 }
 
+// GetMemcachedConnInfo returns what was set up on given connection by
+// this AuthHandler (or its copies) when it was authenticated. Returns
+// false if the connection is unknown.
+func (ah *AuthHandler) GetMemcachedConnInfo(conn *memcached.Client) (MemcachedConnInfo, bool) {
+	if ah.conns == nil {
+		return MemcachedConnInfo{}, false
+	}
+	ac, ok := ah.conns.get(conn)
+	return ac.info, ok
+}
+
+func (ah *AuthHandler) helloFeatures() memcached.Features {
+	features := ah.Features
+	if ah.Collection == "" && ah.Scope == "" {
+		return features
+	}
+	for _, f := range features {
+		if f == memcached.FeatureCollections {
+			return features
+		}
+	}
+	return append(append(memcached.Features{}, features...),
+		memcached.FeatureCollections)
+}
+
+func hello(conn *memcached.Client,
+	features memcached.Features) (memcached.Features, error) {
+	if len(features) == 0 {
+		return nil, nil
+	}
+	res, err := conn.EnableFeatures(features)
+	if err != nil {
+		return nil, err
+	}
+	var rv memcached.Features
+	for i := 0; i+1 < len(res.Body); i += 2 {
+		rv = append(rv, memcached.Feature(
+			binary.BigEndian.Uint16(res.Body[i:])))
+	}
+	return rv, nil
+}
+
+func (ah *AuthHandler) setupContext(conn *memcached.Client,
+	info *MemcachedConnInfo) error {
+	info.Bucket = ah.Bucket
+	info.Scope = ah.Scope
+	info.Collection = ah.Collection
+
+	if ah.Bucket != "" {
+		_, err := conn.SelectBucket(ah.Bucket)
+		if err != nil {
+			return err
+		}
+	}
+	if ah.Collection == "" {
+		return nil
+	}
+	if !info.HasFeature(memcached.FeatureCollections) {
+		return fmt.Errorf("memcached didn't enable collections")
+	}
+	res, err := conn.CollectionsGetCID(ah.Scope, ah.Collection)
+	if err != nil {
+		return err
+	}
+	if len(res.Extras) < 12 {
+		return fmt.Errorf("Unable to get id of collection %s.%s: %v",
+			ah.Scope, ah.Collection, res)
+	}
+	info.CollectionID = binary.BigEndian.Uint32(res.Extras[8:12])
+	return nil
+}
+
 // SetCredsForRequest calls SetRequestAuthVia on given request and
 // authhandler's Authenticator.
 func (ah *AuthHandler) SetCredsForRequest(req *http.Request) error {
@@ -54,27 +248,144 @@ func (ah *AuthHandler) SetCredsForRequest(req *http.Request) error {
 }
 
 // AuthenticateMemcachedConn method grabs creds for given host
-// destination and performs auth and select-bucket on given
-// memcached.Client. It is called by go-couchbase as part of setting
-// up fresh connection in its memcached connections pool.
+// destination and performs HELLO, auth, select-bucket and collection
+// lookup on given memcached.Client. It is called by go-couchbase as
+// part of setting up fresh connection in its memcached connections
+// pool. Strongest SCRAM-SHA mechanism supported by memcached is used
+// for auth. If memcached rejects the creds, auth is retried with
+// rotated service passwords.
 func (ah *AuthHandler) AuthenticateMemcachedConn(host string, conn *memcached.Client) error {
 	return WithAuthenticator(ah.A, func(a Authenticator) error {
-		u, p, err := a.GetMemcachedServiceAuth(host)
+		var info MemcachedConnInfo
+		features, err := hello(conn, ah.helloFeatures())
 		if err != nil {
 			return err
 		}
-		_, err = conn.Auth(u, p)
-		if err == nil && ah.Bucket != "" {
-			_, err = conn.SelectBucket(ah.Bucket)
+		info.Features = features
+
+		var authedPwd string
+		err = withServiceAuth(context.Background(), a, host, true,
+			func(u, p string) (bool, error) {
+				res, err := ah.saslAuth(conn, u, p)
+				if err == nil {
+					authedPwd = p
+				}
+				rejected := res != nil &&
+					res.Status == gomemcached.AUTH_ERROR
+				return rejected, err
+			})
+		if err == nil {
+			err = ah.setupContext(conn, &info)
+		}
+		if err == nil && ah.conns != nil {
+			ah.conns.add(conn, authedConn{pwd: authedPwd, info: info})
 		}
 		return err
 	})
 }
 
+// ReauthenticateMemcachedConn performs auth and select-bucket on given
+// connection again if service password for given host was rotated
+// since the connection was authenticated by this AuthHandler (or its
+// copies). It is meant to be called on pooled connections prior to
+// using them. Connections that AuthHandler doesn't know about are
+// always reauthenticated.
+func (ah *AuthHandler) ReauthenticateMemcachedConn(host string, conn *memcached.Client) error {
+	if ah.conns != nil {
+		ac, ok := ah.conns.get(conn)
+		if ok {
+			err := WithAuthenticator(ah.A, func(a Authenticator) error {
+				_, current, err := a.GetMemcachedServiceAuth(host)
+				if err == nil && current != ac.pwd {
+					ok = false
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if ok {
+			return nil
+		}
+	}
+	return ah.AuthenticateMemcachedConn(host, conn)
+}
+
+// ForgetMemcachedConn makes AuthHandler forget about given connection.
+// It should be called when pool closes the connection.
+func (ah *AuthHandler) ForgetMemcachedConn(conn *memcached.Client) {
+	if ah.conns != nil {
+		ah.conns.forget(conn)
+	}
+}
+
+func (ah *AuthHandler) saslAuth(conn *memcached.Client,
+	user, pwd string) (*gomemcached.MCResponse, error) {
+	res, err := conn.AuthList()
+	if err != nil {
+		return res, err
+	}
+
+	mechs := string(res.Body)
+	method, err := scramsha.BestMethod(mechs)
+	if err == nil {
+		return authScramSha(conn, method, user, pwd)
+	}
+	if ah.AllowPlain && strings.Contains(mechs, "PLAIN") {
+		return conn.AuthPlain(user, pwd)
+	}
+	return nil, fmt.Errorf("none of SASL mechanisms offered by "+
+		"memcached are allowed: %s", mechs)
+}
+
+func authScramSha(conn *memcached.Client,
+	method, user, pwd string) (*gomemcached.MCResponse, error) {
+	s, err := scramsha.NewScramSha(method)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := s.GetStartRequest(user)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(method),
+		Body:   []byte(msg)})
+	if err != nil {
+		return res, err
+	}
+	err = s.HandleStartResponse(string(res.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err = conn.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_STEP,
+		Key:    []byte(method),
+		Body:   []byte(s.GetFinalRequest(pwd))})
+	if err != nil {
+		return res, err
+	}
+	err = s.HandleFinalResponse(string(res.Body))
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // NewAuthHandler returns AuthHandler instance that is using given
 // authenticator instance to authenticate memcached connections for
 // go-couchbase client. If given authenticator is nil, Default
 // authenticator will be used during AuthenticateMemcachedConn calls.
+// Returned AuthHandler (with its copies) remembers connections it
+// authenticated, which ReauthenticateMemcachedConn and
+// GetMemcachedConnInfo rely on.
 func NewAuthHandler(a Authenticator) *AuthHandler {
-	return &AuthHandler{A: a}
+	return &AuthHandler{
+		A:     a,
+		conns: &authedConns{conns: make(map[*memcached.Client]authedConn)},
+	}
 }
@@ -0,0 +1,387 @@
+package cbauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/client"
+	mcserver "github.com/couchbase/gomemcached/server"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// fakeMcd is in-process stand-in of memcached that only knows how to
+// do HELLO, SASL auth, select bucket and collection id lookup.
+type fakeMcd struct {
+	l           sync.Mutex
+	mechs       string
+	user        string
+	pwd         string
+	authed      []string
+	selected    string
+	features    memcached.Features
+	collections map[string]uint32
+
+	scramMech   string
+	scramHash   func() hash.Hash
+	clientFirst string
+	serverFirst string
+}
+
+var fakeSalt = []byte("saltsaltsalt")
+
+const fakeIterations = 16
+
+func (m *fakeMcd) connect(t *testing.T) *memcached.Client {
+	c1, c2 := net.Pipe()
+	go mcserver.HandleIO(c2, mcserver.FuncHandler(m.handle))
+	conn, err := memcached.Wrap(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func (m *fakeMcd) setPassword(pwd string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.pwd = pwd
+}
+
+func (m *fakeMcd) authedMechs() []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return append([]string{}, m.authed...)
+}
+
+func status(s gomemcached.Status, body string) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{Status: s, Body: []byte(body)}
+}
+
+func scramHashFor(mech string) func() hash.Hash {
+	switch mech {
+	case "SCRAM-SHA512":
+		return sha512.New
+	case "SCRAM-SHA256":
+		return sha256.New
+	case "SCRAM-SHA1":
+		return sha1.New
+	}
+	return nil
+}
+
+func hmacSum(h func() hash.Hash, key, msg []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func (m *fakeMcd) handle(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	switch req.Opcode {
+	case gomemcached.HELLO:
+		var body []byte
+		for i := 0; i+1 < len(req.Body); i += 2 {
+			f := memcached.Feature(binary.BigEndian.Uint16(req.Body[i:]))
+			for _, supported := range m.features {
+				if f == supported {
+					body = append(body, req.Body[i:i+2]...)
+				}
+			}
+		}
+		return status(gomemcached.SUCCESS, string(body))
+	case gomemcached.COLLECTIONS_GET_CID:
+		cid, ok := m.collections[string(req.Body)]
+		if !ok {
+			return status(gomemcached.UNKNOWN_COLLECTION, "")
+		}
+		extras := make([]byte, 12)
+		binary.BigEndian.PutUint64(extras, 1)
+		binary.BigEndian.PutUint32(extras[8:], cid)
+		return &gomemcached.MCResponse{
+			Status: gomemcached.SUCCESS, Extras: extras}
+	case gomemcached.SASL_LIST_MECHS:
+		return status(gomemcached.SUCCESS, m.mechs)
+	case gomemcached.SELECT_BUCKET:
+		m.selected = string(req.Key)
+		return status(gomemcached.SUCCESS, "")
+	case gomemcached.SASL_AUTH:
+		mech := string(req.Key)
+		if mech == "PLAIN" {
+			if string(req.Body) != "\x00"+m.user+"\x00"+m.pwd {
+				return status(gomemcached.AUTH_ERROR, "")
+			}
+			m.authed = append(m.authed, mech)
+			return status(gomemcached.SUCCESS, "")
+		}
+		m.scramHash = scramHashFor(mech)
+		if m.scramHash == nil {
+			return status(gomemcached.EINVAL, "")
+		}
+		m.scramMech = mech
+		m.clientFirst = strings.TrimPrefix(string(req.Body), "n,,")
+		var nonce string
+		for _, attr := range strings.Split(m.clientFirst, ",") {
+			if strings.HasPrefix(attr, "r=") {
+				nonce = attr[2:]
+			}
+		}
+		m.serverFirst = fmt.Sprintf("r=%sfakemcd,s=%s,i=%d", nonce,
+			base64.StdEncoding.EncodeToString(fakeSalt),
+			fakeIterations)
+		return status(gomemcached.AUTH_CONTINUE, m.serverFirst)
+	case gomemcached.SASL_STEP:
+		h := m.scramHash
+		msg := string(req.Body)
+		idx := strings.LastIndex(msg, ",p=")
+		proof, err := base64.StdEncoding.DecodeString(msg[idx+3:])
+		if err != nil {
+			return status(gomemcached.EINVAL, "")
+		}
+		authMsg := []byte(m.clientFirst + "," + m.serverFirst + "," +
+			msg[:idx])
+
+		salted := pbkdf2.Key([]byte(m.pwd), fakeSalt, fakeIterations,
+			h().Size(), h)
+		clientKey := hmacSum(h, salted, []byte("Client Key"))
+		storedKey := h()
+		storedKey.Write(clientKey)
+		signature := hmacSum(h, storedKey.Sum(nil), authMsg)
+		for i := range proof {
+			proof[i] ^= signature[i]
+		}
+		if !bytes.Equal(proof, clientKey) {
+			return status(gomemcached.AUTH_ERROR, "")
+		}
+		m.authed = append(m.authed, m.scramMech)
+		serverKey := hmacSum(h, salted, []byte("Server Key"))
+		return status(gomemcached.SUCCESS, "v="+
+			base64.StdEncoding.EncodeToString(
+				hmacSum(h, serverKey, authMsg)))
+	}
+	return status(gomemcached.UNKNOWN_COMMAND, "")
+}
+
+func newMcdTestAuth(pwd string) (*authImpl, *cbauthimpl.Cache) {
+	a := newAuth(0)
+	cache := &cbauthimpl.Cache{
+		Nodes: []cbauthimpl.Node{
+			mkNode("beta.local", "@cbauth", pwd, []int{11210}, false)},
+	}
+	must(a.svc.UpdateDB(cache, nil))
+	return a, cache
+}
+
+func TestAuthHandlerScramSha(t *testing.T) {
+	a, _ := newMcdTestAuth("pwd")
+	for _, mechs := range []string{
+		"SCRAM-SHA512 SCRAM-SHA256 SCRAM-SHA1 PLAIN",
+		"SCRAM-SHA256 SCRAM-SHA1",
+		"SCRAM-SHA1 PLAIN",
+	} {
+		mcd := &fakeMcd{mechs: mechs, user: "@cbauth", pwd: "pwd"}
+		conn := mcd.connect(t)
+		ah := NewAuthHandler(a).ForBucket("default").(*AuthHandler)
+		must(ah.AuthenticateMemcachedConn("beta.local:11210", conn))
+		conn.Close()
+
+		expected := strings.Split(mechs, " ")[0]
+		authed := mcd.authedMechs()
+		if len(authed) != 1 || authed[0] != expected {
+			t.Fatalf("Expected auth via %s. Got: %v", expected, authed)
+		}
+		if mcd.selected != "default" {
+			t.Fatalf("Expected bucket to be selected")
+		}
+	}
+}
+
+func TestAuthHandlerPlainFallback(t *testing.T) {
+	a, _ := newMcdTestAuth("pwd")
+	mcd := &fakeMcd{mechs: "PLAIN", user: "@cbauth", pwd: "pwd"}
+
+	conn := mcd.connect(t)
+	defer conn.Close()
+	ah := NewAuthHandler(a)
+	if ah.AuthenticateMemcachedConn("beta.local:11210", conn) == nil {
+		t.Fatalf("PLAIN must not be used unless allowed")
+	}
+
+	ah.AllowPlain = true
+	must(ah.AuthenticateMemcachedConn("beta.local:11210", conn))
+	if authed := mcd.authedMechs(); len(authed) != 1 ||
+		authed[0] != "PLAIN" {
+		t.Fatalf("Expected auth via PLAIN. Got: %v", authed)
+	}
+}
+
+func TestAuthHandlerReauthAfterRotation(t *testing.T) {
+	a, cache := newMcdTestAuth("old")
+	mcd := &fakeMcd{mechs: "SCRAM-SHA512", user: "@cbauth", pwd: "old"}
+
+	conn := mcd.connect(t)
+	defer conn.Close()
+	ah := NewAuthHandler(a)
+	must(ah.AuthenticateMemcachedConn("beta.local:11210", conn))
+
+	must(ah.ReauthenticateMemcachedConn("beta.local:11210", conn))
+	if n := len(mcd.authedMechs()); n != 1 {
+		t.Fatalf("Connection must not be reauthenticated. Got %d auths", n)
+	}
+
+	mcd.setPassword("new")
+	cache.Nodes[0].Password = "new"
+	must(a.svc.UpdateDB(cache, nil))
+
+	must(ah.ReauthenticateMemcachedConn("beta.local:11210", conn))
+	if n := len(mcd.authedMechs()); n != 2 {
+		t.Fatalf("Connection must be reauthenticated. Got %d auths", n)
+	}
+	must(ah.ReauthenticateMemcachedConn("beta.local:11210", conn))
+	if n := len(mcd.authedMechs()); n != 2 {
+		t.Fatalf("Connection must not be reauthenticated. Got %d auths", n)
+	}
+
+	ah.ForgetMemcachedConn(conn)
+	if _, ok := ah.GetMemcachedConnInfo(conn); ok {
+		t.Fatalf("Connection must be forgotten")
+	}
+	must(ah.ReauthenticateMemcachedConn("beta.local:11210", conn))
+	if n := len(mcd.authedMechs()); n != 3 {
+		t.Fatalf("Unknown connection must be reauthenticated. Got %d auths", n)
+	}
+}
+
+func TestAuthHandlerRemembersBoundedConns(t *testing.T) {
+	defer func(old int) { maxAuthedConns = old }(maxAuthedConns)
+	maxAuthedConns = 1
+
+	a, _ := newMcdTestAuth("pwd")
+	mcd := &fakeMcd{mechs: "SCRAM-SHA512", user: "@cbauth", pwd: "pwd"}
+	ah := NewAuthHandler(a)
+
+	conn1 := mcd.connect(t)
+	must(ah.AuthenticateMemcachedConn("beta.local:11210", conn1))
+	conn2 := mcd.connect(t)
+	defer conn2.Close()
+	must(ah.AuthenticateMemcachedConn("beta.local:11210", conn2))
+	if _, ok := ah.GetMemcachedConnInfo(conn2); ok {
+		t.Fatalf("Connection over the limit must not be remembered")
+	}
+
+	// pools drop connections that failed, so these make room
+	conn1.Close()
+	if _, err := conn1.AuthList(); err == nil || conn1.IsHealthy() {
+		t.Fatalf("Expected closed connection to become unhealthy")
+	}
+	must(ah.AuthenticateMemcachedConn("beta.local:11210", conn2))
+	if _, ok := ah.GetMemcachedConnInfo(conn1); ok {
+		t.Fatalf("Unhealthy connection must be forgotten")
+	}
+	if _, ok := ah.GetMemcachedConnInfo(conn2); !ok {
+		t.Fatalf("Expected connection to be remembered")
+	}
+}
+
+func TestAuthHandlerRetriesRejectedPassword(t *testing.T) {
+	a, cache := newMcdTestAuth("old")
+	mcd := &fakeMcd{mechs: "SCRAM-SHA256", user: "@cbauth", pwd: "new"}
+
+	conn := mcd.connect(t)
+	defer conn.Close()
+
+	go func() {
+		for cbauthimpl.GetRotationStats(a.svc).UpdateWaits == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cache.Nodes[0].Password = "new"
+		must(a.svc.UpdateDB(cache, nil))
+	}()
+
+	must(NewAuthHandler(a).AuthenticateMemcachedConn("beta.local:11210", conn))
+	if n := len(mcd.authedMechs()); n != 1 {
+		t.Fatalf("Expected successful auth. Got %d", n)
+	}
+}
+
+func TestAuthHandlerCollection(t *testing.T) {
+	a, _ := newMcdTestAuth("pwd")
+	mcd := &fakeMcd{
+		mechs:       "SCRAM-SHA512",
+		user:        "@cbauth",
+		pwd:         "pwd",
+		features:    memcached.Features{memcached.FeatureCollections},
+		collections: map[string]uint32{"inventory.airline": 8},
+	}
+
+	conn := mcd.connect(t)
+	defer conn.Close()
+
+	ah := NewAuthHandler(a).ForBucket("travel").(*AuthHandler)
+	ah.Features = memcached.Features{memcached.FeatureXerror}
+	ah = ah.ForCollection("inventory", "airline")
+	must(ah.AuthenticateMemcachedConn("beta.local:11210", conn))
+
+	// info is recorded at auth time, not looked up on memcached
+	mcd.l.Lock()
+	delete(mcd.collections, "inventory.airline")
+	mcd.l.Unlock()
+
+	info, ok := ah.GetMemcachedConnInfo(conn)
+	if !ok {
+		t.Fatalf("Expected connection to be known")
+	}
+	if !info.HasFeature(memcached.FeatureCollections) ||
+		info.HasFeature(memcached.FeatureXerror) {
+		t.Fatalf("Unexpected negotiated features: %v", info.Features)
+	}
+	if info.Bucket != "travel" || info.Scope != "inventory" ||
+		info.Collection != "airline" || info.CollectionID != 8 {
+		t.Fatalf("Unexpected connection info: %+v", info)
+	}
+	if info.ClientContext().CollId != 8 {
+		t.Fatalf("Expected client context for collection 8")
+	}
+	if mcd.selected != "travel" {
+		t.Fatalf("Expected bucket to be selected")
+	}
+
+	conn2 := mcd.connect(t)
+	defer conn2.Close()
+	err := ah.ForCollection("inventory", "hotel").
+		AuthenticateMemcachedConn("beta.local:11210", conn2)
+	if err == nil {
+		t.Fatalf("Expected unknown collection to fail")
+	}
+}
+
+func TestAuthHandlerCollectionsNotSupported(t *testing.T) {
+	a, _ := newMcdTestAuth("pwd")
+	mcd := &fakeMcd{mechs: "SCRAM-SHA512", user: "@cbauth", pwd: "pwd"}
+
+	conn := mcd.connect(t)
+	defer conn.Close()
+
+	ah := NewAuthHandler(a).ForBucket("travel").(*AuthHandler)
+	err := ah.ForCollection("inventory", "airline").
+		AuthenticateMemcachedConn("beta.local:11210", conn)
+	if err == nil {
+		t.Fatalf("Expected failure when collections are not enabled")
+	}
+}
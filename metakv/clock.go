@@ -0,0 +1,22 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import "github.com/couchbase/cbauth/utils"
+
+// Clock is source of time for watchers and leases. It exists so that
+// they can be tested without actually waiting.
+type Clock = utils.Clock
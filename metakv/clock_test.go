@@ -0,0 +1,86 @@
+package metakv
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+type fakeClock struct {
+	l      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t.ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.ch <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// waitTimers waits until there are at least n pending timers.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	t.Helper()
+	c.waitTimersIn(t, n, -1)
+}
+
+// waitTimersIn waits until there are at least n pending timers that
+// fire in d, or at any time if d is negative.
+func (c *fakeClock) waitTimersIn(t *testing.T, n int, d time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.l.Lock()
+		count := 0
+		for _, timer := range c.timers {
+			if d < 0 || timer.at.Equal(c.now.Add(d)) {
+				count++
+			}
+		}
+		c.l.Unlock()
+		if count >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d timers (have %d)",
+				n, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,127 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// MaxUpdateAttempts is how many times Update tries to apply the
+// update before giving up on concurrent mutators.
+const MaxUpdateAttempts = 16
+
+// GetJSON returns json value of given key unmarshalled into T along
+// with its revision. Returns nil value, nil rev and nil error when
+// given path doesn't exist.
+func GetJSON[T any](path string) (value *T, rev interface{}, err error) {
+	return GetJSONVia[T](context.Background(), defaultClient, path)
+}
+
+// GetJSONVia is GetJSON that uses given client and gives up when ctx
+// is done.
+func GetJSONVia[T any](ctx context.Context, c *Client, path string) (value *T, rev interface{}, err error) {
+	raw, rev, err := c.GetContext(ctx, path)
+	if err != nil || rev == nil {
+		return nil, nil, err
+	}
+	value = new(T)
+	err = json.Unmarshal(raw, value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("metakv: bad json value of %s: %w",
+			path, err)
+	}
+	return value, rev, nil
+}
+
+// SetJSON stores value marshalled into json under given key. Rev has
+// the same meaning as in Set.
+func SetJSON[T any](path string, value T, rev interface{}) error {
+	return SetJSONVia(context.Background(), defaultClient, path, value, rev)
+}
+
+// SetJSONVia is SetJSON that uses given client and gives up when ctx
+// is done.
+func SetJSONVia[T any](ctx context.Context, c *Client, path string, value T, rev interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.SetContext(ctx, path, raw, rev)
+}
+
+// Update does read-modify-write of json value of given key. Fn is
+// passed current value, or nil if key doesn't exist, and returns new
+// value. If fn returns nil value, nothing is written. Missing key is
+// created (as if by Add). If the key is concurrently changed or
+// deleted, Update calls fn again with new current value, up to
+// MaxUpdateAttempts times, after which error wrapping ErrRevMismatch is
+// returned. Error returned by fn is returned as is. See UpdateExisting
+// for Update that doesn't create the key.
+func Update[T any](path string, fn func(old *T) (*T, error)) error {
+	return UpdateVia(context.Background(), defaultClient, path, fn)
+}
+
+// UpdateVia is Update that uses given client and gives up when ctx is
+// done.
+func UpdateVia[T any](ctx context.Context, c *Client, path string,
+	fn func(old *T) (*T, error)) error {
+	return doUpdate(ctx, c, path, true, fn)
+}
+
+// UpdateExisting is Update that only updates existing key: if the key
+// doesn't exist (or gets deleted concurrently), ErrNotFound is
+// returned without calling fn (again). Fn is never passed nil.
+func UpdateExisting[T any](path string, fn func(old *T) (*T, error)) error {
+	return UpdateExistingVia(context.Background(), defaultClient, path, fn)
+}
+
+// UpdateExistingVia is UpdateExisting that uses given client and gives
+// up when ctx is done.
+func UpdateExistingVia[T any](ctx context.Context, c *Client, path string,
+	fn func(old *T) (*T, error)) error {
+	return doUpdate(ctx, c, path, false, fn)
+}
+
+func doUpdate[T any](ctx context.Context, c *Client, path string,
+	create bool, fn func(old *T) (*T, error)) error {
+	for i := 0; i < MaxUpdateAttempts; i++ {
+		old, rev, err := GetJSONVia[T](ctx, c, path)
+		if err != nil {
+			return err
+		}
+		if rev == nil {
+			if !create {
+				return ErrNotFound
+			}
+			rev = RevCreate
+		}
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+		err = SetJSONVia(ctx, c, path, value, rev)
+		if err != ErrRevMismatch && err != ErrNotFound {
+			return err
+		}
+	}
+	return fmt.Errorf("metakv: gave up updating %s after %d attempts: %w",
+		path, MaxUpdateAttempts, ErrRevMismatch)
+}
@@ -0,0 +1,244 @@
+package metakv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type settings struct {
+	Counter int    `json:"counter"`
+	Name    string `json:"name"`
+}
+
+func newMockClient(t *testing.T) (*mockKV, *Client) {
+	kv := &mockKV{}
+	t.Cleanup(kv.runMock())
+	c, err := NewClient(kv.srv.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	return kv, c
+}
+
+// newBreakableClient returns client of kv whose requests fail while
+// returned flag is non-zero.
+func newBreakableClient(t *testing.T, kv *mockKV) (*Client, *int32) {
+	broken := new(int32)
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(broken) != 0 {
+			return nil, errors.New("broken")
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	c, err := NewClient(kv.srv.URL, rt, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	return c, broken
+}
+
+func TestJSON(t *testing.T) {
+	_, c := newMockClient(t)
+	ctx := context.Background()
+
+	v, rev, err := GetJSONVia[settings](ctx, c, "/s")
+	if v != nil || rev != nil || err != nil {
+		t.Fatalf("unexpected result for missing key: %v %v %v",
+			v, rev, err)
+	}
+
+	err = SetJSONVia(ctx, c, "/s", settings{1, "a"}, RevCreate)
+	if err != nil {
+		t.Fatalf("SetJSONVia failed: %v", err)
+	}
+	err = SetJSONVia(ctx, c, "/s", settings{2, "b"}, RevCreate)
+	if err != ErrRevMismatch {
+		t.Fatalf("expected ErrRevMismatch, got: %v", err)
+	}
+
+	v, rev, err = GetJSONVia[settings](ctx, c, "/s")
+	if err != nil || rev == nil || *v != (settings{1, "a"}) {
+		t.Fatalf("unexpected value: %v %v %v", v, rev, err)
+	}
+
+	if err := c.Set("/bad", []byte("{"), nil); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	var serr *json.SyntaxError
+	if _, _, err := GetJSONVia[settings](ctx, c, "/bad"); !errors.As(err, &serr) {
+		t.Fatalf("expected syntax error, got: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	_, c := newMockClient(t)
+	ctx := context.Background()
+
+	incr := func(old *settings) (*settings, error) {
+		if old == nil {
+			return &settings{Counter: 1}, nil
+		}
+		old.Counter++
+		return old, nil
+	}
+
+	const workers = 4
+	const perWorker = 5
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				if err := UpdateVia(ctx, c, "/cnt", incr); err != nil {
+					t.Errorf("UpdateVia failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, _, err := GetJSONVia[settings](ctx, c, "/cnt")
+	if err != nil || v.Counter != workers*perWorker {
+		t.Fatalf("unexpected counter: %v %v", v, err)
+	}
+
+	calls := 0
+	err = UpdateVia(ctx, c, "/cnt", func(old *settings) (*settings, error) {
+		calls++
+		return nil, nil
+	})
+	if err != nil || calls != 1 {
+		t.Fatalf("unexpected no-op update: %v %d", err, calls)
+	}
+
+	fnErr := errors.New("fn error")
+	err = UpdateVia(ctx, c, "/cnt", func(old *settings) (*settings, error) {
+		return nil, fnErr
+	})
+	if err != fnErr {
+		t.Fatalf("expected fn error, got: %v", err)
+	}
+
+	calls = 0
+	err = UpdateVia(ctx, c, "/cnt", func(old *settings) (*settings, error) {
+		calls++
+		// concurrent mutator that always wins
+		if err := SetJSONVia(ctx, c, "/cnt", old, nil); err != nil {
+			t.Fatalf("SetJSONVia failed: %v", err)
+		}
+		return old, nil
+	})
+	if !errors.Is(err, ErrRevMismatch) || calls != MaxUpdateAttempts {
+		t.Fatalf("expected to give up after %d attempts, got: %v %d",
+			MaxUpdateAttempts, err, calls)
+	}
+}
+
+func TestUpdateRetriesDeletedKey(t *testing.T) {
+	kv, c := newMockClient(t)
+	ctx := context.Background()
+
+	// ns_server responds with 404 when key with given rev is gone
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "PUT" {
+				req.ParseForm()
+				kv.l.Lock()
+				_, exists := kv.data["/cnt"]
+				kv.l.Unlock()
+				if req.PostForm.Get("rev") != "" && !exists {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+			}
+			kv.Handle(w, req)
+		}))
+	defer srv.Close()
+	c, err := NewClient(srv.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	if err := SetJSONVia(ctx, c, "/cnt", settings{Counter: 5}, nil); err != nil {
+		t.Fatalf("SetJSONVia failed: %v", err)
+	}
+	var seen []*settings
+	err = UpdateVia(ctx, c, "/cnt", func(old *settings) (*settings, error) {
+		seen = append(seen, old)
+		if len(seen) == 1 {
+			if err := c.Delete("/cnt", nil); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+		}
+		if old == nil {
+			return &settings{Counter: 1}, nil
+		}
+		old.Counter++
+		return old, nil
+	})
+	if err != nil || len(seen) != 2 || seen[1] != nil {
+		t.Fatalf("expected update to be retried on deleted key: %v %v",
+			err, seen)
+	}
+	v, _, err := GetJSONVia[settings](ctx, c, "/cnt")
+	if err != nil || v.Counter != 1 {
+		t.Fatalf("unexpected value: %v %v", v, err)
+	}
+}
+
+func TestUpdateExisting(t *testing.T) {
+	_, c := newMockClient(t)
+	ctx := context.Background()
+
+	calls := 0
+	incr := func(old *settings) (*settings, error) {
+		calls++
+		if old == nil {
+			t.Fatalf("fn must not be passed nil")
+		}
+		old.Counter++
+		return old, nil
+	}
+
+	if err := UpdateExistingVia(ctx, c, "/cnt", incr); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+	if v, rev, _ := c.Get("/cnt"); v != nil || rev != nil || calls != 0 {
+		t.Fatalf("missing key must not be created: %s %d", v, calls)
+	}
+
+	if err := SetJSONVia(ctx, c, "/cnt", settings{Counter: 5}, nil); err != nil {
+		t.Fatalf("SetJSONVia failed: %v", err)
+	}
+	if err := UpdateExistingVia(ctx, c, "/cnt", incr); err != nil {
+		t.Fatalf("UpdateExistingVia failed: %v", err)
+	}
+	v, _, err := GetJSONVia[settings](ctx, c, "/cnt")
+	if err != nil || v.Counter != 6 {
+		t.Fatalf("unexpected value: %v %v", v, err)
+	}
+
+	calls = 0
+	err = UpdateExistingVia(ctx, c, "/cnt", func(old *settings) (*settings, error) {
+		calls++
+		// concurrent deletion
+		if err := c.Delete("/cnt", nil); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		return old, nil
+	})
+	if err != ErrNotFound || calls != 1 {
+		t.Fatalf("expected ErrNotFound after deletion, got: %v %d",
+			err, calls)
+	}
+	if v, rev, _ := c.Get("/cnt"); v != nil || rev != nil {
+		t.Fatalf("deleted key must not be recreated: %s", v)
+	}
+}
@@ -0,0 +1,365 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/logging"
+	"github.com/couchbase/cbauth/utils"
+)
+
+// ErrLeaseLost is Lease.Err() of lease that was taken over by another
+// holder or couldn't be renewed in time.
+var ErrLeaseLost = errors.New("metakv lease is lost")
+
+// ErrLeaseReleased is Lease.Err() of released lease.
+var ErrLeaseReleased = errors.New("metakv lease is released")
+
+// LeaseOptions configure leases. Zero fields take default values.
+type LeaseOptions struct {
+	// TTL is how long lease stays valid without renewal. Default is
+	// 15s.
+	TTL time.Duration
+	// RenewInterval is how often holder renews the lease. Default
+	// is TTL/3.
+	RenewInterval time.Duration
+	// RetryInterval is how often AcquireLease checks the lease
+	// held by somebody else. Default is TTL/3.
+	RetryInterval time.Duration
+	// Clock, if non-nil, replaces real time.
+	Clock Clock
+}
+
+func (o *LeaseOptions) withDefaults() LeaseOptions {
+	var rv LeaseOptions
+	if o != nil {
+		rv = *o
+	}
+	if rv.TTL <= 0 {
+		rv.TTL = 15 * time.Second
+	}
+	if rv.RenewInterval <= 0 {
+		rv.RenewInterval = rv.TTL / 3
+	}
+	if rv.RetryInterval <= 0 {
+		rv.RetryInterval = rv.TTL / 3
+	}
+	if rv.Clock == nil {
+		rv.Clock = utils.RealClock{}
+	}
+	return rv
+}
+
+// leaseValue is stored under the lease key. TTL is in nanoseconds.
+type leaseValue struct {
+	Holder string        `json:"holder"`
+	TTL    time.Duration `json:"ttl"`
+}
+
+// Lease is exclusive claim on metakv key that is kept by periodic
+// renewal. Lease expires if it's not renewed for TTL. Expiry is judged
+// by contenders on their own clocks, by watching revision of the key
+// not changing for TTL, so clocks of nodes don't need to be in sync.
+// Holder in turn considers lease lost once TTL passes since it started
+// the last successful renewal, i.e. before anybody can take it over.
+type Lease struct {
+	c      *Client
+	path   string
+	holder string
+	o      LeaseOptions
+
+	rev        interface{}
+	validUntil time.Time
+
+	lost chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	l   sync.Mutex
+	err error
+}
+
+// setLease stores lease value with given rev and returns new revision
+// of the key. ErrRevMismatch is returned if the key is concurrently
+// taken by somebody else.
+func (c *Client) setLease(ctx context.Context, path string, v *leaseValue,
+	rev interface{}) (interface{}, error) {
+	err := SetJSONVia(ctx, c, path, v, rev)
+	if err != nil {
+		return nil, err
+	}
+	cur, newRev, err := GetJSONVia[leaseValue](ctx, c, path)
+	if err != nil {
+		return nil, err
+	}
+	if cur == nil || cur.Holder != v.Holder {
+		return nil, ErrRevMismatch
+	}
+	return newRev, nil
+}
+
+// AcquireLease waits until lease on given key is acquired for given
+// holder. Lease held by somebody else is taken over once it expires.
+// Lease held by the same holder, e.g. before restart, is taken over
+// right away. Returns ctx.Err() if ctx gets done first. Lease must be
+// released when it's not needed anymore.
+func (c *Client) AcquireLease(ctx context.Context, path, holder string,
+	opts *LeaseOptions) (*Lease, error) {
+	assertValidPath(path)
+	o := opts.withDefaults()
+	v := &leaseValue{Holder: holder, TTL: o.TTL}
+
+	var seenRev []byte
+	var seenAt time.Time
+	for {
+		start := o.Clock.Now()
+		cur, rev, err := GetJSONVia[leaseValue](ctx, c, path)
+		var setRev interface{}
+		switch {
+		case err != nil:
+		case rev == nil:
+			setRev = RevCreate
+		case cur.Holder == holder:
+			setRev = rev
+		case !bytes.Equal(rev.([]byte), seenRev):
+			// holder may have renewed right before the reply,
+			// so TTL is counted from the moment of the reply
+			seenRev = rev.([]byte)
+			seenAt = o.Clock.Now()
+		case start.Sub(seenAt) >= cur.TTL:
+			logging.Info("metakv: taking over expired lease",
+				"path", path, "holder", holder, "from", cur.Holder)
+			setRev = rev
+		}
+
+		if setRev != nil {
+			rev, err = c.setLease(ctx, path, v, setRev)
+			if err == nil {
+				return c.newLease(path, holder, o, rev, start), nil
+			}
+		}
+		if err != nil && err != ErrRevMismatch && ctx.Err() == nil {
+			logging.Warn("metakv: failed to acquire lease",
+				"path", path, "holder", holder, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-o.Clock.After(o.RetryInterval):
+		}
+	}
+}
+
+func (c *Client) newLease(path, holder string, o LeaseOptions,
+	rev interface{}, acquiredAt time.Time) *Lease {
+	l := &Lease{
+		c:          c,
+		path:       path,
+		holder:     holder,
+		o:          o,
+		rev:        rev,
+		validUntil: acquiredAt.Add(o.TTL),
+		lost:       make(chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go l.renew()
+	return l
+}
+
+func (l *Lease) lose(err error) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if l.err == nil {
+		l.err = err
+		close(l.lost)
+	}
+}
+
+type renewal struct {
+	start time.Time
+	rev   interface{}
+	err   error
+}
+
+// renew renews the lease every RenewInterval. Expiry is tracked by
+// separate timer, so the lease is lost at validUntil even if renewal
+// hangs. The timer is pushed back lazily, when it fires after
+// successful renewal.
+func (l *Lease) renew() {
+	defer close(l.done)
+	v := &leaseValue{Holder: l.holder, TTL: l.o.TTL}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := l.o.Clock
+	expiry := clock.After(l.validUntil.Sub(clock.Now()))
+	tick := clock.After(l.o.RenewInterval)
+	// non-nil while renewal is in flight
+	var renewed chan renewal
+	for {
+		select {
+		case <-l.stop:
+			if renewed == nil {
+				return
+			}
+			// let renewal finish (but not past expiry), so
+			// that Release deletes the key with its revision
+			select {
+			case r := <-renewed:
+				if r.err == nil {
+					l.rev = r.rev
+				}
+			case <-expiry:
+			}
+			return
+		case <-expiry:
+			now := clock.Now()
+			if now.Before(l.validUntil) {
+				// renewed since the timer was armed
+				expiry = clock.After(l.validUntil.Sub(now))
+				continue
+			}
+			logging.Warn("metakv: lease expired", "path", l.path,
+				"holder", l.holder)
+			l.lose(ErrLeaseLost)
+			return
+		case <-tick:
+			renewed = make(chan renewal, 1)
+			go func(start time.Time, rev interface{}) {
+				rev, err := l.c.setLease(ctx, l.path, v, rev)
+				renewed <- renewal{start, rev, err}
+			}(clock.Now(), l.rev)
+		case r := <-renewed:
+			renewed = nil
+			switch {
+			case r.err == nil:
+				l.rev = r.rev
+				l.validUntil = r.start.Add(l.o.TTL)
+			case errors.Is(r.err, ErrRevMismatch):
+				logging.Warn("metakv: lease was taken over",
+					"path", l.path, "holder", l.holder)
+				l.lose(ErrLeaseLost)
+				return
+			default:
+				logging.Warn("metakv: failed to renew lease",
+					"path", l.path, "holder", l.holder, "err", r.err)
+			}
+			tick = clock.After(l.o.RenewInterval)
+		}
+	}
+}
+
+// Path returns the key of the lease.
+func (l *Lease) Path() string {
+	return l.path
+}
+
+// Holder returns holder id of the lease.
+func (l *Lease) Holder() string {
+	return l.holder
+}
+
+// Lost returns channel that is closed when lease is lost or released.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns nil while lease is held, ErrLeaseLost if it was lost and
+// ErrLeaseReleased if it was released.
+func (l *Lease) Err() error {
+	l.l.Lock()
+	defer l.l.Unlock()
+	return l.err
+}
+
+// Release stops renewing the lease and deletes its key, so that others
+// can acquire it right away.
+func (l *Lease) Release() error {
+	select {
+	case <-l.stop:
+		<-l.done
+		return nil
+	default:
+	}
+	close(l.stop)
+	<-l.done
+	if l.Err() != nil {
+		return nil
+	}
+	l.lose(ErrLeaseReleased)
+	err := l.c.Delete(l.path, l.rev)
+	if err == ErrRevMismatch || err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func newHolderID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Elect waits until this process becomes the leader for given key,
+// i.e. acquires lease on it with unique holder id. Returned context is
+// done when leadership is lost or when ctx is done, in which case the
+// lease is released. Returns ctx.Err() if ctx gets done before
+// election.
+func (c *Client) Elect(ctx context.Context, path string,
+	opts *LeaseOptions) (context.Context, error) {
+	lease, err := c.AcquireLease(ctx, path, newHolderID(), opts)
+	if err != nil {
+		return nil, err
+	}
+	leaderCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-lease.Lost():
+		case <-ctx.Done():
+			err := lease.Release()
+			if err != nil {
+				logging.Warn("metakv: failed to release lease",
+					"path", path, "err", err)
+			}
+		}
+	}()
+	return leaderCtx, nil
+}
+
+// AcquireLease is Client.AcquireLease of default client.
+func AcquireLease(ctx context.Context, path, holder string,
+	opts *LeaseOptions) (*Lease, error) {
+	return defaultClient.AcquireLease(ctx, path, holder, opts)
+}
+
+// Elect is Client.Elect of default client.
+func Elect(ctx context.Context, path string,
+	opts *LeaseOptions) (context.Context, error) {
+	return defaultClient.Elect(ctx, path, opts)
+}
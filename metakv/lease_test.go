@@ -0,0 +1,250 @@
+package metakv
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func expectClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// leaseOptions returns options with TTL that isn't multiple of renew
+// and retry intervals, so that expiry timers never fire together with
+// renewals and retries.
+func leaseOptions(clock Clock) *LeaseOptions {
+	return &LeaseOptions{
+		TTL:           10 * time.Second,
+		RenewInterval: 3 * time.Second,
+		RetryInterval: 3 * time.Second,
+		Clock:         clock,
+	}
+}
+
+func TestLease(t *testing.T) {
+	kv, b := newMockClient(t)
+	a, broken := newBreakableClient(t, kv)
+
+	clock := newFakeClock()
+	opts := leaseOptions(clock)
+	ctx := context.Background()
+
+	la, err := a.AcquireLease(ctx, "/lock", "a", opts)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	if la.Err() != nil {
+		t.Fatalf("fresh lease has error %v", la.Err())
+	}
+
+	type result struct {
+		l   *Lease
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		l, err := b.AcquireLease(ctx, "/lock", "b", opts)
+		resCh <- result{l, err}
+	}()
+
+	// renewed lease is never taken over
+	for i := 0; i < 6; i++ {
+		clock.waitTimersIn(t, 2, 3*time.Second)
+		clock.Advance(3 * time.Second)
+	}
+	clock.waitTimersIn(t, 2, 3*time.Second)
+	select {
+	case r := <-resCh:
+		t.Fatalf("lease was taken over while renewed: %v", r.err)
+	case <-la.Lost():
+		t.Fatalf("lease was lost while renewed: %v", la.Err())
+	default:
+	}
+
+	// once holder fails to renew for TTL, it loses the lease and
+	// contender takes it over
+	atomic.StoreInt32(broken, 1)
+	for i := 0; i < 3; i++ {
+		clock.Advance(3 * time.Second)
+		clock.waitTimersIn(t, 2, 3*time.Second)
+	}
+	clock.Advance(3 * time.Second)
+	expectClosed(t, la.Lost(), "lease loss")
+	if la.Err() != ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost, got %v", la.Err())
+	}
+
+	var r result
+	select {
+	case r = <-resCh:
+	case <-time.After(50 * time.Millisecond):
+		clock.waitTimersIn(t, 1, 3*time.Second)
+		clock.Advance(3 * time.Second)
+		r = <-resCh
+	}
+	if r.err != nil {
+		t.Fatalf("AcquireLease failed: %v", r.err)
+	}
+	lb := r.l
+
+	cur, _, err := GetJSONVia[leaseValue](ctx, b, "/lock")
+	if err != nil || cur == nil || cur.Holder != "b" || cur.TTL != opts.TTL {
+		t.Fatalf("unexpected lease value %v (err %v)", cur, err)
+	}
+
+	// releasing lease that was lost doesn't touch the key
+	atomic.StoreInt32(broken, 0)
+	if err := la.Release(); err != nil {
+		t.Fatalf("Release of lost lease failed: %v", err)
+	}
+	if la.Err() != ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost, got %v", la.Err())
+	}
+
+	// the same holder takes its lease over right away
+	lb2, err := b.AcquireLease(ctx, "/lock", "b", opts)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	clock.waitTimersIn(t, 2, 3*time.Second)
+	clock.Advance(3 * time.Second)
+	expectClosed(t, lb.Lost(), "lease loss")
+
+	if err := lb2.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	expectClosed(t, lb2.Lost(), "lease release")
+	if lb2.Err() != ErrLeaseReleased {
+		t.Fatalf("expected ErrLeaseReleased, got %v", lb2.Err())
+	}
+	_, rev, err := b.Get("/lock")
+	if err != nil || rev != nil {
+		t.Fatalf("lease key wasn't deleted: %v, %v", rev, err)
+	}
+	if err := lb2.Release(); err != nil {
+		t.Fatalf("second Release failed: %v", err)
+	}
+}
+
+func TestLeaseExpiresWhileRenewalHangs(t *testing.T) {
+	kv, _ := newMockClient(t)
+	var hang int32
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.LoadInt32(&hang) != 0 {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	c, err := NewClient(kv.srv.URL, rt, nil)
+	must(t).ok(err)
+
+	clock := newFakeClock()
+	opts := leaseOptions(clock)
+	l, err := c.AcquireLease(context.Background(), "/lock", "a", opts)
+	must(t).ok(err)
+
+	atomic.StoreInt32(&hang, 1)
+	clock.waitTimersIn(t, 1, 3*time.Second)
+	clock.Advance(3 * time.Second)
+	select {
+	case <-l.Lost():
+		t.Fatalf("lease was lost before TTL: %v", l.Err())
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(7 * time.Second)
+	expectClosed(t, l.Lost(), "lease loss")
+	if l.Err() != ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost, got %v", l.Err())
+	}
+	atomic.StoreInt32(&hang, 0)
+	must(t).ok(l.Release())
+}
+
+func TestLeaseCanceled(t *testing.T) {
+	_, c := newMockClient(t)
+	clock := newFakeClock()
+	opts := leaseOptions(clock)
+
+	l, err := c.AcquireLease(context.Background(), "/lock", "a", opts)
+	if err != nil {
+		t.Fatalf("AcquireLease failed: %v", err)
+	}
+	defer l.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.AcquireLease(ctx, "/lock", "b", opts)
+		errCh <- err
+	}()
+	clock.waitTimersIn(t, 2, 3*time.Second)
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AcquireLease didn't return after cancel")
+	}
+}
+
+func TestElect(t *testing.T) {
+	_, c := newMockClient(t)
+	clock := newFakeClock()
+	opts := leaseOptions(clock)
+
+	// leadership ends when lease is taken over
+	leaderCtx, err := c.Elect(context.Background(), "/leader", opts)
+	if err != nil {
+		t.Fatalf("Elect failed: %v", err)
+	}
+	err = SetJSONVia(context.Background(), c, "/leader",
+		&leaseValue{Holder: "other", TTL: opts.TTL}, nil)
+	if err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	clock.waitTimersIn(t, 1, 3*time.Second)
+	clock.Advance(3 * time.Second)
+	expectClosed(t, leaderCtx.Done(), "end of leadership")
+	if err := c.Delete("/leader", nil); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// leadership is given up when ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderCtx, err = c.Elect(ctx, "/leader", opts)
+	if err != nil {
+		t.Fatalf("Elect failed: %v", err)
+	}
+	cur, _, err := GetJSONVia[leaseValue](ctx, c, "/leader")
+	if err != nil || cur == nil || cur.Holder == "" {
+		t.Fatalf("unexpected lease value %v (err %v)", cur, err)
+	}
+	cancel()
+	expectClosed(t, leaderCtx.Done(), "end of leadership")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, rev, err := c.Get("/leader")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if rev == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lease wasn't released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
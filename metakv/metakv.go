@@ -24,6 +24,7 @@
 package metakv
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,6 +34,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/couchbase/cbauth"
 	"github.com/couchbase/cbauth/utils"
@@ -42,7 +44,43 @@ import (
 // rev mismatch
 var ErrRevMismatch = errors.New("Rev mismatch")
 
-var errNotFound = errors.New("Not found")
+// ErrNotFound is returned when mutated key doesn't exist. Get reports
+// missing keys as nil value and nil rev instead.
+var ErrNotFound = errors.New("Not found")
+
+// TransportError is returned when request to _metakv could not be
+// sent, its response could not be read or context got done while
+// waiting for it. Errors of reading entries streamed to
+// IterateChildren and RunObserveChildren callbacks (e.g. io.EOF when
+// ns_server closes continuous feed) are returned as is.
+type TransportError struct {
+	Method string
+	Path   string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("metakv %s %s: %v", e.Method, e.Path, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError is returned when _metakv responds with unexpected
+// status.
+type ServerError struct {
+	StatusCode int
+	Status     string
+	// Body is (possibly truncated) body of the response.
+	Body []byte
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("ns_server _metakv returned: %s", e.Status)
+}
+
+const maxErrorBody = 4096
 
 // KVEntry struct represents kv entry returned from ListAllChildren and
 // used as a parameter in Callback
@@ -61,41 +99,124 @@ type Callback func(entry KVEntry) error
 // Set to Add.
 var RevCreate = &struct{}{}
 
-type store struct {
+// Authenticator supplies credentials for requests to _metakv
+// endpoint. cbauth.Authenticator implements it.
+type Authenticator interface {
+	GetHTTPServiceAuth(hostport string) (user, pwd string, err error)
+}
+
+// Client is metakv client bound to _metakv endpoint of particular
+// ns_server. Package level functions use default client that talks to
+// local ns_server (see DefaultClient). Client is safe for concurrent
+// use.
+type Client struct {
 	url    *url.URL
 	client *http.Client
+	// timeoutClient is used for requests that have no deadline
+	timeoutClient *http.Client
 }
 
+// RequestTimeout limits how long requests of Client may take when
+// their context has no deadline (as with functions that don't take
+// context). Continuous feeds of RunObserveChildren and Watch are not
+// limited.
+const RequestTimeout = 30 * time.Second
+
 const uaMetaKvSuffix = "metakv"
 const uaMetaKvVersion = ""
 
 var userAgent = utils.MakeUserAgent(uaMetaKvSuffix, uaMetaKvVersion)
 
-var defaultStore = initDefaultStore()
-
-func initDefaultStore() *store {
-	c := *http.DefaultClient
-	c.Transport = cbauth.WrapHTTPTransport(http.DefaultTransport, nil)
+var defaultClient = initDefaultClient()
 
+func initDefaultClient() *Client {
 	authURL := os.Getenv("CBAUTH_REVRPC_URL")
 	u, err := url.Parse(authURL)
-	if err == nil {
-		u.RawQuery = ""
-		u.Fragment = ""
-		u.Path = "/_metakv"
-		u.User = nil
+	if err != nil {
+		u = &url.URL{}
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.Path = ""
+	u.User = nil
+	return newClient(u,
+		cbauth.WrapHTTPTransport(http.DefaultTransport, nil))
+}
+
+func newClient(base *url.URL, rt http.RoundTripper) *Client {
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/_metakv"
+	return &Client{
+		url:           &u,
+		client:        &http.Client{Transport: rt},
+		timeoutClient: &http.Client{Transport: rt, Timeout: RequestTimeout},
+	}
+}
+
+// DefaultClient returns client used by package level functions. It
+// talks to ns_server that cbauth is connected to (as given by
+// CBAUTH_REVRPC_URL) using cbauth.Default for authentication.
+func DefaultClient() *Client {
+	return defaultClient
+}
+
+// NewClient returns client of _metakv endpoint of ns_server at given
+// base url (e.g. http://127.0.0.1:8091). Requests are sent via given
+// transport, or http.DefaultTransport if it's nil, with credentials
+// that auth returns for the ns_server's host:port. cbauth
+// authenticators additionally get requests retried on password
+// rotation. nil auth means requests are sent without credentials.
+func NewClient(baseURL string, rt http.RoundTripper, auth Authenticator) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("metakv: invalid base url %q", baseURL)
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.User = nil
+
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	switch a := auth.(type) {
+	case nil:
+	case cbauth.Authenticator:
+		rt = cbauth.WrapHTTPTransport(rt, a)
+	default:
+		rt = &authRoundTripper{rt: rt, auth: a}
+	}
+	return newClient(u, rt), nil
+}
+
+type authRoundTripper struct {
+	rt   http.RoundTripper
+	auth Authenticator
+}
+
+func (t *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	user, pwd, err := t.auth.GetHTTPServiceAuth(req.URL.Host)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
 	}
-	return &store{url: u, client: &c}
+	r := req.Clone(req.Context())
+	r.SetBasicAuth(user, pwd)
+	return t.rt.RoundTrip(r)
 }
 
-func doCallInner(s *store, method, path string, values url.Values) (resp *http.Response, err error) {
+func doCallInner(ctx context.Context, c *Client, method, path string, values url.Values) (resp *http.Response, err error) {
 	var body io.Reader
 	if method == "PUT" && values != nil {
 		body = strings.NewReader(values.Encode())
 	}
-	url := *s.url
+	url := *c.url
 	url.Path += path
-	req, err := http.NewRequest(method, url.String(), body)
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), body)
 	if err != nil {
 		return nil, err
 	}
@@ -108,35 +229,45 @@ func doCallInner(s *store, method, path string, values url.Values) (resp *http.R
 
 	req.Header.Set("User-Agent", userAgent)
 
-	r, err := s.client.Do(req)
+	client := c.client
+	if _, ok := ctx.Deadline(); !ok &&
+		req.URL.Query().Get("feed") != "continuous" {
+		client = c.timeoutClient
+	}
+	r, err := client.Do(req)
 	if err != nil {
-		return r, err
+		return r, &TransportError{method, path, err}
 	}
 	if r.StatusCode == http.StatusConflict {
 		return r, ErrRevMismatch
 	}
 	if r.StatusCode == http.StatusNotFound {
-		return r, errNotFound
+		return r, ErrNotFound
 	}
 	if r.StatusCode != 200 {
-		return r, fmt.Errorf("ns_server _metakv returned: %s", r.Status)
+		b, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorBody))
+		return r, &ServerError{r.StatusCode, r.Status, b}
 	}
 	return r, err
 }
 
-func doCall(s *store, method, path string, values url.Values) (body []byte, err error) {
-	r, err := doCallInner(s, method, path, values)
+func doCall(ctx context.Context, c *Client, method, path string, values url.Values) (body []byte, err error) {
+	r, err := doCallInner(ctx, c, method, path, values)
 	if r != nil {
 		defer r.Body.Close()
 	}
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(r.Body)
+	body, err = ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, &TransportError{method, path, err}
+	}
+	return body, nil
 }
 
-func doJSONCall(s *store, method, path string, values url.Values, place interface{}) error {
-	body, err := doCall(s, method, path, values)
+func doJSONCall(ctx context.Context, c *Client, method, path string, values url.Values, place interface{}) error {
+	body, err := doCall(ctx, c, method, path, values)
 	if err != nil {
 		return err
 	}
@@ -174,11 +305,16 @@ func assertValidDirPath(path string) {
 
 // Get returns matching value and revision for given key. Returns nil
 // value, nil rev and nil error when given path doesn't exist.
-func (s *store) get(path string) (value []byte, rev interface{}, err error) {
+func (c *Client) Get(path string) (value []byte, rev interface{}, err error) {
+	return c.GetContext(context.Background(), path)
+}
+
+// GetContext is Get that gives up when ctx is done.
+func (c *Client) GetContext(ctx context.Context, path string) (value []byte, rev interface{}, err error) {
 	assertValidPath(path)
 	var kve kvEntry
-	err = doJSONCall(s, "GET", path, nil, &kve)
-	if err == errNotFound {
+	err = doJSONCall(ctx, c, "GET", path, nil, &kve)
+	if err == ErrNotFound {
 		return nil, nil, nil
 	}
 	if err != nil {
@@ -191,7 +327,7 @@ func (s *store) get(path string) (value []byte, rev interface{}, err error) {
 	return kve.Value, rev, nil
 }
 
-func mutate(s *store, method string, path string, value []byte, rev interface{}, create bool, sensitive bool) error {
+func mutate(ctx context.Context, c *Client, method string, path string, value []byte, rev interface{}, create bool, sensitive bool) error {
 	values := url.Values{
 		"value": {string(value)},
 	}
@@ -215,7 +351,7 @@ func mutate(s *store, method string, path string, value []byte, rev interface{},
 		values.Set("sensitive", "false")
 	}
 
-	_, err := doCall(s, method, path, values)
+	_, err := doCall(ctx, c, method, path, values)
 	return err
 }
 
@@ -223,34 +359,90 @@ func mutate(s *store, method string, path string, value []byte, rev interface{},
 // value used to detect races with concurrent mutators in typical
 // read-modify-write cases. Rev is supposed to be same value that is
 // returned from get.
-func (s *store) set(path string, value []byte, rev interface{}, sensitive bool) error {
+func (c *Client) Set(path string, value []byte, rev interface{}) error {
+	return c.SetContext(context.Background(), path, value, rev)
+}
+
+// SetContext is Set that gives up when ctx is done.
+func (c *Client) SetContext(ctx context.Context, path string, value []byte, rev interface{}) error {
 	assertValidPath(path)
-	return mutate(s, "PUT", path, value, rev, false, sensitive)
+	return mutate(ctx, c, "PUT", path, value, rev, false, false)
+}
+
+// SetSensitive is Set for storing sensitive info.
+func (c *Client) SetSensitive(path string, value []byte, rev interface{}) error {
+	return c.SetSensitiveContext(context.Background(), path, value, rev)
+}
+
+// SetSensitiveContext is SetSensitive that gives up when ctx is done.
+func (c *Client) SetSensitiveContext(ctx context.Context, path string, value []byte, rev interface{}) error {
+	assertValidPath(path)
+	return mutate(ctx, c, "PUT", path, value, rev, false, true)
 }
 
 // Add creates given kv pair. Which must not exist in storage
 // yet. ErrRevMismatch is returned if pair with such key exists.
-func (s *store) add(path string, value []byte, sensitive bool) error {
+func (c *Client) Add(path string, value []byte) error {
+	return c.AddContext(context.Background(), path, value)
+}
+
+// AddContext is Add that gives up when ctx is done.
+func (c *Client) AddContext(ctx context.Context, path string, value []byte) error {
 	assertValidPath(path)
-	return mutate(s, "PUT", path, value, nil, true, sensitive)
+	return mutate(ctx, c, "PUT", path, value, nil, true, false)
+}
+
+// AddSensitive is Add for storing sensitive info.
+func (c *Client) AddSensitive(path string, value []byte) error {
+	return c.AddSensitiveContext(context.Background(), path, value)
+}
+
+// AddSensitiveContext is AddSensitive that gives up when ctx is done.
+func (c *Client) AddSensitiveContext(ctx context.Context, path string, value []byte) error {
+	assertValidPath(path)
+	return mutate(ctx, c, "PUT", path, value, nil, true, true)
 }
 
 // Delete deletes given key.
-func (s *store) delete(path string, rev interface{}) error {
+func (c *Client) Delete(path string, rev interface{}) error {
+	return c.DeleteContext(context.Background(), path, rev)
+}
+
+// DeleteContext is Delete that gives up when ctx is done.
+func (c *Client) DeleteContext(ctx context.Context, path string, rev interface{}) error {
 	assertValidPath(path)
-	return mutate(s, "DELETE", path, nil, rev, false, false)
+	return mutate(ctx, c, "DELETE", path, nil, rev, false, false)
 }
 
-// Recursive Delete deletes all keys that are children of given directory path.
-func (s *store) recursiveDelete(dirpath string) error {
+// RecursiveDelete deletes all keys that are children of given directory path.
+func (c *Client) RecursiveDelete(dirpath string) error {
+	return c.RecursiveDeleteContext(context.Background(), dirpath)
+}
+
+// RecursiveDeleteContext is RecursiveDelete that gives up when ctx is
+// done.
+func (c *Client) RecursiveDeleteContext(ctx context.Context, dirpath string) error {
 	assertValidDirPath(dirpath)
-	return mutate(s, "DELETE", dirpath, nil, nil, false, false)
+	return mutate(ctx, c, "DELETE", dirpath, nil, nil, false, false)
+}
+
+func toCallbackInt(callback Callback) callbackInt {
+	return func(e kvEntry) error {
+		return callback(KVEntry{e.Path, e.Value, e.Rev, e.Sensitive})
+	}
 }
 
 // IterateChildren invokes given callback on every kv-pair that's
 // child of given directory path. Path must end on "/".
-func (s *store) iterateChildren(dirpath string, callback callbackInt) error {
-	return doRunObserveChildren(s, dirpath, callback, nil)
+func (c *Client) IterateChildren(dirpath string, callback Callback) error {
+	return c.IterateChildrenContext(context.Background(), dirpath, callback)
+}
+
+// IterateChildrenContext is IterateChildren that gives up when ctx is
+// done.
+func (c *Client) IterateChildrenContext(ctx context.Context, dirpath string, callback Callback) error {
+	return doRunObserveChildren(ctx, c, dirpath, toCallbackInt(callback),
+		false)
 }
 
 // RunObserveChildren invokes gen callback on every kv-pair that is
@@ -260,59 +452,109 @@ func (s *store) iterateChildren(dirpath string, callback callbackInt) error {
 // when children callback returns error. If exit is due to cancel
 // channel being closed returned error is nil. Otherwise error is
 // non-nil. Path must end on "/".
-func (s *store) runObserveChildren(dirpath string, callback callbackInt,
+//
+// RunObserveChildren doesn't reconnect: it returns error as soon as
+// the feed breaks, and mutations that happen until it's called again
+// are lost. Use Watch for feed that survives reconnections.
+func (c *Client) RunObserveChildren(dirpath string, callback Callback,
+	cancel <-chan struct{}) error {
+	return c.runObserveChildren(dirpath, toCallbackInt(callback), cancel)
+}
+
+// RunObserveChildrenContext is RunObserveChildren that runs until ctx
+// is done, in which case ctx.Err() is returned.
+func (c *Client) RunObserveChildrenContext(ctx context.Context, dirpath string,
+	callback Callback) error {
+	return doRunObserveChildren(ctx, c, dirpath, toCallbackInt(callback),
+		true)
+}
+
+func (c *Client) runObserveChildren(dirpath string, callback callbackInt,
 	cancel <-chan struct{}) error {
 	if cancel == nil {
 		return nil
 	}
-	return doRunObserveChildren(s, dirpath, callback, cancel)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	err := doRunObserveChildren(ctx, c, dirpath, callback, true)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
 }
 
-func doRunObserveChildren(s *store, dirpath string, callback callbackInt,
-	cancel <-chan struct{}) error {
+func doRunObserveChildren(ctx context.Context, c *Client, dirpath string,
+	callback callbackInt, continuous bool) error {
+	r, err := openObserveChildren(ctx, c, dirpath, continuous)
+	if err != nil {
+		return err
+	}
+	return readObserveChildren(ctx, r, callback, continuous)
+}
+
+// openObserveChildren sends iteration request and returns response
+// whose body streams the entries.
+func openObserveChildren(ctx context.Context, c *Client, dirpath string,
+	continuous bool) (*http.Response, error) {
 	assertValidDirPath(dirpath)
 	values := url.Values{}
-	if cancel != nil {
+	if continuous {
 		values.Set("feed", "continuous")
 	}
-	r, err := doCallInner(s, "GET", dirpath, values)
-	if r != nil {
-		defer r.Body.Close()
-	}
+	r, err := doCallInner(ctx, c, "GET", dirpath, values)
 	if err != nil {
-		return err
+		if r != nil {
+			r.Body.Close()
+		}
+		return nil, err
 	}
+	return r, nil
+}
+
+// readObserveChildren passes entries streamed by response of
+// openObserveChildren to callback. It closes the response.
+func readObserveChildren(ctx context.Context, r *http.Response,
+	callback callbackInt, continuous bool) error {
+	defer r.Body.Close()
+	var err error
 
 	errChan := make(chan error, 1)
 	kveChan := make(chan kvEntry)
+	// closed on return, which stops the decoder goroutine even if
+	// it's blocked on delivering an entry
+	done := make(chan struct{})
+	defer close(done)
 
 	go func() {
 		dec := json.NewDecoder(r.Body)
-		var kve kvEntry
 		for {
+			// decoding into the same entry would make
+			// consecutive entries share Value and Rev
+			var kve kvEntry
 			err := dec.Decode(&kve)
 			if err != nil {
 				errChan <- err
-				close(kveChan)
 				return
 			}
-			kveChan <- kve
+			select {
+			case kveChan <- kve:
+			case <-done:
+				return
+			}
 		}
 	}()
 
-	effCancel := cancel
-	if cancel == nil {
-		effCancel = make(chan struct{})
-	}
-
 readLoop:
 	for {
 		select {
-		case kve, ok := <-kveChan:
-			if !ok {
-				err = <-errChan
-				break readLoop
-			}
+		case kve := <-kveChan:
 			err = callback(kve)
 			if err != nil {
 				return err
@@ -321,25 +563,49 @@ readLoop:
 		case err = <-errChan:
 			break readLoop
 
-		case <-effCancel:
-			r.Body.Close()
-			// ensure that worker goroutine is done
-			for range kveChan {
-			}
-			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	if cancel == nil && err == io.EOF {
-		err = nil
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if !continuous && err == io.EOF {
+		return nil
 	}
 	return err
 }
 
+// ListAllChildren returns all child entries of given "directory" node.
+func (c *Client) ListAllChildren(dirpath string) (entries []KVEntry, err error) {
+	return c.ListAllChildrenContext(context.Background(), dirpath)
+}
+
+// ListAllChildrenContext is ListAllChildren that gives up when ctx is
+// done.
+func (c *Client) ListAllChildrenContext(ctx context.Context, dirpath string) (entries []KVEntry, err error) {
+	// nil could be used here, but then empty list becomes nil and
+	// in my testing code it means json null is returned rather
+	// than empty json array.
+	entries = make([]KVEntry, 0, 16)
+	err = c.IterateChildrenContext(ctx, dirpath,
+		func(e KVEntry) error {
+			entries = append(entries, e)
+			return nil
+		})
+	return
+}
+
 // Get returns matching value and revision for given key. Returns nil
 // value, nil rev and nil error when given path doesn't exist.
 func Get(path string) (value []byte, rev interface{}, err error) {
-	return defaultStore.get(path)
+	return defaultClient.Get(path)
+}
+
+// GetContext is Get that gives up when ctx is done.
+func GetContext(ctx context.Context, path string) (value []byte, rev interface{}, err error) {
+	return defaultClient.GetContext(ctx, path)
 }
 
 // Set updates given key-value pair. If non-nil, rev is a form of CAS
@@ -347,43 +613,76 @@ func Get(path string) (value []byte, rev interface{}, err error) {
 // read-modify-write cases. Rev is supposed to be same value that is
 // returned from get.
 func Set(path string, value []byte, rev interface{}) error {
-	return defaultStore.set(path, value, rev, false)
+	return defaultClient.Set(path, value, rev)
+}
+
+// SetContext is Set that gives up when ctx is done.
+func SetContext(ctx context.Context, path string, value []byte, rev interface{}) error {
+	return defaultClient.SetContext(ctx, path, value, rev)
 }
 
 // SetSensitive is Set for storing sensitive info.
 func SetSensitive(path string, value []byte, rev interface{}) error {
-	return defaultStore.set(path, value, rev, true)
+	return defaultClient.SetSensitive(path, value, rev)
+}
+
+// SetSensitiveContext is SetSensitive that gives up when ctx is done.
+func SetSensitiveContext(ctx context.Context, path string, value []byte, rev interface{}) error {
+	return defaultClient.SetSensitiveContext(ctx, path, value, rev)
 }
 
 // Add creates given kv pair. Which must not exist in storage
 // yet. ErrRevMismatch is returned if pair with such key exists.
 func Add(path string, value []byte) error {
-	return defaultStore.add(path, value, false)
+	return defaultClient.Add(path, value)
+}
+
+// AddContext is Add that gives up when ctx is done.
+func AddContext(ctx context.Context, path string, value []byte) error {
+	return defaultClient.AddContext(ctx, path, value)
 }
 
 // AddSensitive is Add for storing sensitive info.
 func AddSensitive(path string, value []byte) error {
-	return defaultStore.add(path, value, true)
+	return defaultClient.AddSensitive(path, value)
+}
+
+// AddSensitiveContext is AddSensitive that gives up when ctx is done.
+func AddSensitiveContext(ctx context.Context, path string, value []byte) error {
+	return defaultClient.AddSensitiveContext(ctx, path, value)
 }
 
 // Delete deletes given key.
 func Delete(path string, rev interface{}) error {
-	return defaultStore.delete(path, rev)
+	return defaultClient.Delete(path, rev)
+}
+
+// DeleteContext is Delete that gives up when ctx is done.
+func DeleteContext(ctx context.Context, path string, rev interface{}) error {
+	return defaultClient.DeleteContext(ctx, path, rev)
 }
 
 // RecursiveDelete deletes all keys that are children of given directory path.
 func RecursiveDelete(dirpath string) error {
-	return defaultStore.recursiveDelete(dirpath)
+	return defaultClient.RecursiveDelete(dirpath)
+}
+
+// RecursiveDeleteContext is RecursiveDelete that gives up when ctx is
+// done.
+func RecursiveDeleteContext(ctx context.Context, dirpath string) error {
+	return defaultClient.RecursiveDeleteContext(ctx, dirpath)
 }
 
 // IterateChildren invokes given callback on every kv-pair that's
 // child of given directory path. Path must end on "/".
 func IterateChildren(dirpath string, callback Callback) error {
-	return defaultStore.iterateChildren(dirpath,
-		func(e kvEntry) error {
-			return callback(KVEntry{e.Path, e.Value, e.Rev,
-				e.Sensitive})
-		})
+	return defaultClient.IterateChildren(dirpath, callback)
+}
+
+// IterateChildrenContext is IterateChildren that gives up when ctx is
+// done.
+func IterateChildrenContext(ctx context.Context, dirpath string, callback Callback) error {
+	return defaultClient.IterateChildrenContext(ctx, dirpath, callback)
 }
 
 // RunObserveChildren invokes gen callback on every kv-pair that is
@@ -392,32 +691,27 @@ func IterateChildren(dirpath string, callback Callback) error {
 // argument of callback. Returns only when cancel channel is closed or
 // when children callback returns error. If exit is due to cancel
 // channel being closed returned error is nil. Otherwise error is
-// non-nil. Path must end on "/".
+// non-nil. Path must end on "/". It doesn't reconnect when the feed
+// breaks, see Watch for that.
 func RunObserveChildren(dirpath string, callback Callback,
 	cancel <-chan struct{}) error {
-	return defaultStore.runObserveChildren(dirpath,
-		func(e kvEntry) error {
-			return callback(KVEntry{e.Path, e.Value, e.Rev,
-				e.Sensitive})
-		}, cancel)
+	return defaultClient.RunObserveChildren(dirpath, callback, cancel)
+}
+
+// RunObserveChildrenContext is RunObserveChildren that runs until ctx
+// is done, in which case ctx.Err() is returned.
+func RunObserveChildrenContext(ctx context.Context, dirpath string,
+	callback Callback) error {
+	return defaultClient.RunObserveChildrenContext(ctx, dirpath, callback)
 }
 
 // ListAllChildren returns all child entries of given "directory" node.
 func ListAllChildren(dirpath string) (entries []KVEntry, err error) {
-	return defaultStore.listAllChildren(dirpath)
+	return defaultClient.ListAllChildren(dirpath)
 }
 
-// ListAllChildren returns all child entries of given "directory" node.
-func (s *store) listAllChildren(dirpath string) (entries []KVEntry, err error) {
-	// nil could be used here, but then empty list becomes nil and
-	// in my testing code it means json null is returned rather
-	// than empty json array.
-	entries = make([]KVEntry, 0, 16)
-	err = s.iterateChildren(dirpath,
-		func(e kvEntry) error {
-			entries = append(entries,
-				KVEntry{e.Path, e.Value, e.Rev, e.Sensitive})
-			return nil
-		})
-	return
+// ListAllChildrenContext is ListAllChildren that gives up when ctx is
+// done.
+func ListAllChildrenContext(ctx context.Context, dirpath string) (entries []KVEntry, err error) {
+	return defaultClient.ListAllChildrenContext(ctx, dirpath)
 }
@@ -1,8 +1,11 @@
 package metakv
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	log "github.com/couchbase/clog"
 )
@@ -41,6 +45,14 @@ func (kv *mockKV) runMock() func() {
 	}
 }
 
+// dropConns breaks all connections to kv, including continuous feeds.
+// Idle connections are forgotten by clients too, so that following
+// requests don't fail on reused dead connection.
+func (kv *mockKV) dropConns() {
+	kv.srv.CloseClientConnections()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+}
+
 func replyJSON(w http.ResponseWriter, value interface{}) {
 	json.NewEncoder(w).Encode(value)
 }
@@ -217,6 +229,13 @@ func (t *myT) okStatus(statusCode int, err error) {
 	}
 }
 
+func (t *myT) ok(err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func (t *myT) emptyBody(resp *http.Response, err error) {
 	defer resp.Body.Close()
 	t.okStatus(resp.StatusCode, err)
@@ -279,18 +298,242 @@ func TestSanity(t *testing.T) {
 	kv := &mockKV{}
 	defer kv.runMock()()
 
-	url, err := url.Parse(kv.srv.URL + "/_metakv")
+	c, err := NewClient(kv.srv.URL, nil, nil)
 	if err != nil {
-		panic(err)
+		t.Fatalf("NewClient failed: %v", err)
 	}
 
-	mockStore := &store{
-		url:    url,
-		client: http.DefaultClient,
+	if err := c.Add("/_sanity/garbage", []byte("v")); err != nil {
+		t.Logf("add failed with: %v", err)
 	}
+	c.ExecuteBasicSanityTest(t.Log)
+}
 
-	if err := mockStore.add("/_sanity/garbage", []byte("v"), false); err != nil {
-		t.Logf("add failed with: %v", err)
+type fakeAuth struct{ hostport string }
+
+func (a *fakeAuth) GetHTTPServiceAuth(hostport string) (string, string, error) {
+	a.hostport = hostport
+	return "@metakv", "secret", nil
+}
+
+type rtFunc func(*http.Request) (*http.Response, error)
+
+func (f rtFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestClient(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+
+	auth := &fakeAuth{}
+	var requests []string
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		user, pwd, ok := req.BasicAuth()
+		if !ok || user != "@metakv" || pwd != "secret" {
+			t.Errorf("unexpected creds: %q %q %v", user, pwd, ok)
+		}
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	c, err := NewClient(kv.srv.URL+"/", rt, auth)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	if err := c.Add("/test/a", []byte("1")); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := c.Add("/test/a", []byte("2")); err != ErrRevMismatch {
+		t.Fatalf("expected ErrRevMismatch, got: %v", err)
+	}
+	v, rev, err := c.Get("/test/a")
+	if err != nil || string(v) != "1" || rev == nil {
+		t.Fatalf("unexpected Get result: %q %v %v", v, rev, err)
+	}
+	if err := c.SetSensitive("/test/b", []byte("2"), nil); err != nil {
+		t.Fatalf("SetSensitive failed: %v", err)
+	}
+	l, err := c.ListAllChildren("/test/")
+	if err != nil {
+		t.Fatalf("ListAllChildren failed: %v", err)
+	}
+	if len(l) != 2 || l[0].Path != "/test/a" || l[1].Path != "/test/b" ||
+		!l[1].Sensitive || string(l[1].Value) != "2" {
+		t.Fatalf("unexpected children: %v", l)
+	}
+	if err := c.Delete("/test/a", rev); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if u := kv.srv.URL; auth.hostport != strings.TrimPrefix(u, "http://") {
+		t.Fatalf("creds requested for %q, server is %s",
+			auth.hostport, u)
+	}
+	if requests[0] != "PUT /_metakv/test/a" {
+		t.Fatalf("unexpected request: %s", requests[0])
+	}
+}
+
+func TestNewClientBadURL(t *testing.T) {
+	for _, u := range []string{"", "127.0.0.1:8091", "http://%zz"} {
+		if _, err := NewClient(u, nil, nil); err == nil {
+			t.Errorf("expected error for %q", u)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("feed") == "continuous" {
+				w.Write([]byte(`{"path":"/dir/a","value":"MQ=="}` + "\n"))
+				w.(http.Flusher).Flush()
+			}
+			select {
+			case <-hang:
+			case <-req.Context().Done():
+			}
+		}))
+	defer srv.Close()
+	defer close(hang)
+
+	c, err := NewClient(srv.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, _, err = c.GetContext(ctx, "/key")
+	var terr *TransportError
+	if !errors.As(err, &terr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected transport error caused by deadline, got: %v",
+			err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.RunObserveChildrenContext(ctx, "/dir/",
+			func(e KVEntry) error {
+				if e.Path != "/dir/a" || string(e.Value) != "1" {
+					t.Errorf("unexpected entry: %v", e)
+				}
+				cancel()
+				return nil
+			})
+	}()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RunObserveChildrenContext didn't return")
+	}
+
+	cancelCh := make(chan struct{})
+	go func() {
+		errCh <- c.RunObserveChildren("/dir/", func(e KVEntry) error {
+			close(cancelCh)
+			return nil
+		}, cancelCh)
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatalf("expected nil on cancel, got: %v", err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/_metakv/missing":
+				w.WriteHeader(http.StatusNotFound)
+			case "/_metakv/conflict":
+				w.WriteHeader(http.StatusConflict)
+			default:
+				http.Error(w, "boom", http.StatusInternalServerError)
+			}
+		}))
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	if err := c.Delete("/missing", nil); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+	if v, r, err := c.Get("/missing"); v != nil || r != nil || err != nil {
+		t.Fatalf("unexpected Get of missing key: %v %v %v", v, r, err)
+	}
+	if err := c.Set("/conflict", nil, nil); err != ErrRevMismatch {
+		t.Fatalf("expected ErrRevMismatch, got: %v", err)
+	}
+
+	err = c.Add("/other", []byte("v"))
+	var serr *ServerError
+	if !errors.As(err, &serr) || serr.StatusCode != 500 ||
+		strings.TrimSpace(string(serr.Body)) != "boom" {
+		t.Fatalf("expected server error, got: %v", err)
+	}
+
+	srv.Close()
+	_, err = c.ListAllChildren("/dir/")
+	var terr *TransportError
+	if !errors.As(err, &terr) || terr.Method != "GET" ||
+		terr.Path != "/dir/" {
+		t.Fatalf("expected transport error, got: %v", err)
+	}
+}
+
+func TestFeedEOFAndRequestTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("feed") == "continuous" {
+				w.Write([]byte(`{"path":"/dir/a","value":"MQ=="}` + "\n"))
+				return
+			}
+			select {
+			case <-hang:
+			case <-req.Context().Done():
+			}
+		}))
+	defer srv.Close()
+	defer close(hang)
+
+	c, err := NewClient(srv.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+
+	// callers of RunObserveChildren compare the error with io.EOF
+	err = c.RunObserveChildren("/dir/", func(KVEntry) error { return nil },
+		make(chan struct{}))
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF when feed is closed, got: %v", err)
+	}
+
+	c.timeoutClient.Timeout = 50 * time.Millisecond
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := c.Get("/key")
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		var terr *TransportError
+		if !errors.As(err, &terr) {
+			t.Fatalf("expected transport error, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Get without context didn't time out")
 	}
-	doExecuteBasicSanityTest(t.Log, mockStore)
 }
@@ -0,0 +1,390 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metakvtest provides in-process stand-in of ns_server's
+// _metakv REST endpoint, so that users of metakv can be tested without
+// a cluster.
+package metakvtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/cbauth/metakv"
+)
+
+// Prefix is the path _metakv endpoint is served under.
+const Prefix = "/_metakv"
+
+// feedBuffer is how many mutations continuous feed may lag behind
+// before it's disconnected.
+const feedBuffer = 1024
+
+type feedEntry struct {
+	Path      string `json:"path"`
+	Value     []byte `json:"value"`
+	Rev       []byte `json:"rev"`
+	Sensitive bool   `json:"sensitive"`
+}
+
+type feed struct {
+	dirpath string
+	ch      chan feedEntry
+	// closed when feed lags too much or handler is closed
+	done chan struct{}
+}
+
+// Handler serves _metakv REST API under Prefix:
+//
+//   - GET of a key returns {"value", "rev"} object, or empty object if
+//     key doesn't exist (as ns_server does).
+//   - PUT of a key takes "value", "rev", "create" and "sensitive" form
+//     values and responds with 409 if rev doesn't match or key exists
+//     and create is set.
+//   - DELETE of a key takes "rev" query value and responds with 409 if
+//     it doesn't match and with 404 if key doesn't exist.
+//   - GET of a directory (path ending with "/") streams its entries as
+//     json objects {"path", "value", "rev", "sensitive"}. With
+//     feed=continuous the stream continues with mutations, deletions
+//     having null value and rev.
+//   - DELETE of a directory deletes all keys under it.
+//
+// Values and revisions are base64 encoded in json. Every mutation is
+// saved to the storage.
+type Handler struct {
+	storage Storage
+
+	l      sync.Mutex
+	state  *State
+	feeds  map[*feed]struct{}
+	closed bool
+}
+
+// NewHandler returns Handler that keeps data in given storage. Nil
+// storage means data is kept only in memory.
+func NewHandler(storage Storage) (*Handler, error) {
+	if storage == nil {
+		storage = NewMemoryStorage()
+	}
+	state, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &State{}
+	}
+	if state.Entries == nil {
+		state.Entries = make(map[string]Entry)
+	}
+	return &Handler{
+		storage: storage,
+		state:   state,
+		feeds:   make(map[*feed]struct{}),
+	}, nil
+}
+
+// Close disconnects all continuous feeds and makes handler refuse
+// further feeds.
+func (h *Handler) Close() {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.closed = true
+	for f := range h.feeds {
+		h.dropFeedLocked(f)
+	}
+}
+
+// Entries returns copy of all entries keyed by path.
+func (h *Handler) Entries() map[string]Entry {
+	h.l.Lock()
+	defer h.l.Unlock()
+	rv := make(map[string]Entry, len(h.state.Entries))
+	for k, v := range h.state.Entries {
+		rv[k] = v
+	}
+	return rv
+}
+
+func (h *Handler) dropFeedLocked(f *feed) {
+	if _, ok := h.feeds[f]; ok {
+		delete(h.feeds, f)
+		close(f.done)
+	}
+}
+
+func (h *Handler) notifyLocked(path string, e *Entry) {
+	fe := feedEntry{Path: path}
+	if e != nil {
+		fe.Value = e.Value
+		fe.Rev = e.Rev
+		fe.Sensitive = e.Sensitive
+	}
+	for f := range h.feeds {
+		if !strings.HasPrefix(path, f.dirpath) {
+			continue
+		}
+		select {
+		case f.ch <- fe:
+		default:
+			h.dropFeedLocked(f)
+		}
+	}
+}
+
+func (h *Handler) nextRevLocked() []byte {
+	h.state.Rev++
+	return []byte(strconv.FormatUint(h.state.Rev, 10))
+}
+
+func (h *Handler) setLocked(path string, value []byte, sensitive bool) {
+	e := Entry{Value: value, Rev: h.nextRevLocked(), Sensitive: sensitive}
+	h.state.Entries[path] = e
+	h.notifyLocked(path, &e)
+}
+
+func (h *Handler) deleteLocked(path string) {
+	delete(h.state.Entries, path)
+	h.notifyLocked(path, nil)
+}
+
+// commitLocked saves the state after mutation. Mutations are applied
+// before they are saved, so failure to save is only reported.
+func (h *Handler) commitLocked(w http.ResponseWriter) {
+	err := h.storage.Save(h.state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, Prefix) {
+		http.NotFound(w, req)
+		return
+	}
+	path := req.URL.Path[len(Prefix):]
+	if path == "" || path[0] != '/' {
+		http.NotFound(w, req)
+		return
+	}
+	isDir := strings.HasSuffix(path, "/")
+
+	switch {
+	case req.Method == "GET" && isDir:
+		h.handleIterate(w, req, path)
+	case req.Method == "GET":
+		h.handleGet(w, req, path)
+	case req.Method == "PUT" && !isDir:
+		h.handlePut(w, req, path)
+	case req.Method == "DELETE" && isDir:
+		h.handleRecursiveDelete(w, path)
+	case req.Method == "DELETE":
+		h.handleDelete(w, req, path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func replyJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (h *Handler) handleGet(w http.ResponseWriter, req *http.Request, path string) {
+	h.l.Lock()
+	e, ok := h.state.Entries[path]
+	h.l.Unlock()
+	if !ok {
+		replyJSON(w, struct{}{})
+		return
+	}
+	replyJSON(w, map[string][]byte{"value": e.Value, "rev": e.Rev})
+}
+
+// checkRevLocked returns true if rev given by client matches current
+// revision of the key. Empty rev matches anything.
+func (h *Handler) checkRevLocked(path string, rev []byte) bool {
+	if len(rev) == 0 {
+		return true
+	}
+	e, ok := h.state.Entries[path]
+	return ok && bytes.Equal(e.Rev, rev)
+}
+
+func (h *Handler) handlePut(w http.ResponseWriter, req *http.Request, path string) {
+	err := req.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	form := req.PostForm
+	create := form.Get("create") != ""
+	sensitive := form.Get("sensitive") == "true"
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	if !h.checkRevLocked(path, []byte(form.Get("rev"))) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if _, exists := h.state.Entries[path]; exists && create {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	h.setLocked(path, []byte(form.Get("value")), sensitive)
+	h.commitLocked(w)
+}
+
+func (h *Handler) handleDelete(w http.ResponseWriter, req *http.Request, path string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	if _, exists := h.state.Entries[path]; !exists {
+		http.NotFound(w, req)
+		return
+	}
+	if !h.checkRevLocked(path, []byte(req.URL.Query().Get("rev"))) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	h.deleteLocked(path)
+	h.commitLocked(w)
+}
+
+func (h *Handler) handleRecursiveDelete(w http.ResponseWriter, dirpath string) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	for _, path := range h.childrenLocked(dirpath) {
+		h.deleteLocked(path)
+	}
+	h.commitLocked(w)
+}
+
+func (h *Handler) childrenLocked(dirpath string) []string {
+	var rv []string
+	for path := range h.state.Entries {
+		if strings.HasPrefix(path, dirpath) {
+			rv = append(rv, path)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func (h *Handler) handleIterate(w http.ResponseWriter, req *http.Request, dirpath string) {
+	continuous := req.URL.Query().Get("feed") == "continuous"
+
+	h.l.Lock()
+	paths := h.childrenLocked(dirpath)
+	entries := make([]feedEntry, len(paths))
+	for i, path := range paths {
+		e := h.state.Entries[path]
+		entries[i] = feedEntry{path, e.Value, e.Rev, e.Sensitive}
+	}
+	var f *feed
+	if continuous {
+		if h.closed {
+			h.l.Unlock()
+			http.Error(w, "metakvtest handler is closed",
+				http.StatusServiceUnavailable)
+			return
+		}
+		f = &feed{
+			dirpath: dirpath,
+			ch:      make(chan feedEntry, feedBuffer),
+			done:    make(chan struct{}),
+		}
+		h.feeds[f] = struct{}{}
+	}
+	h.l.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if enc.Encode(e) != nil {
+			break
+		}
+	}
+	if f == nil {
+		return
+	}
+	defer func() {
+		h.l.Lock()
+		h.dropFeedLocked(f)
+		h.l.Unlock()
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case e := <-f.ch:
+			if enc.Encode(e) != nil {
+				return
+			}
+		case <-f.done:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Server is Handler served by httptest.Server.
+type Server struct {
+	*Handler
+	// URL is base url of the server, suitable for metakv.NewClient.
+	URL string
+
+	srv *httptest.Server
+}
+
+// NewServer starts Server that keeps data in given storage. Nil
+// storage means data is kept only in memory.
+func NewServer(storage Storage) (*Server, error) {
+	h, err := NewHandler(storage)
+	if err != nil {
+		return nil, err
+	}
+	srv := httptest.NewServer(h)
+	return &Server{Handler: h, URL: srv.URL, srv: srv}, nil
+}
+
+// Client returns metakv client of the server.
+func (s *Server) Client() *metakv.Client {
+	c, err := metakv.NewClient(s.URL, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// CloseClientConnections breaks all connections to the server,
+// including continuous feeds.
+func (s *Server) CloseClientConnections() {
+	s.srv.CloseClientConnections()
+}
+
+// Close disconnects feeds and shuts down the server.
+func (s *Server) Close() {
+	s.Handler.Close()
+	s.srv.Close()
+}
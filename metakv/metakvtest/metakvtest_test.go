@@ -0,0 +1,251 @@
+package metakvtest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/metakv"
+)
+
+func newServer(t *testing.T, storage Storage) *Server {
+	s, err := NewServer(storage)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSanity(t *testing.T) {
+	s := newServer(t, nil)
+	s.Client().ExecuteBasicSanityTest(t.Log)
+}
+
+func do(t *testing.T, s *Server, method, path string, values url.Values) int {
+	t.Helper()
+	var body *strings.Reader
+	if method == "PUT" {
+		body = strings.NewReader(values.Encode())
+	} else {
+		body = strings.NewReader("")
+		path += "?" + values.Encode()
+	}
+	req, err := http.NewRequest(method, s.URL+Prefix+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRESTSemantics(t *testing.T) {
+	s := newServer(t, nil)
+
+	expect := func(code, expected int) {
+		t.Helper()
+		if code != expected {
+			t.Fatalf("expected status %d, got %d", expected, code)
+		}
+	}
+	// like ns_server, missing key is reported as empty object
+	expect(do(t, s, "GET", "/a", nil), 200)
+	if v, rev, err := s.Client().Get("/a"); v != nil || rev != nil || err != nil {
+		t.Fatalf("unexpected result for missing key: %v %v %v", v, rev, err)
+	}
+	expect(do(t, s, "DELETE", "/a", nil), 404)
+	expect(do(t, s, "PUT", "/a", url.Values{"value": {"1"}, "rev": {"1"}}), 409)
+	expect(do(t, s, "PUT", "/a", url.Values{"value": {"1"}, "create": {"1"}}), 200)
+	expect(do(t, s, "PUT", "/a", url.Values{"value": {"2"}, "create": {"1"}}), 409)
+
+	rev := s.Entries()["/a"].Rev
+	expect(do(t, s, "PUT", "/a", url.Values{"value": {"2"}, "rev": {"bogus"}}), 409)
+	expect(do(t, s, "PUT", "/a", url.Values{"value": {"2"}, "rev": {string(rev)}}), 200)
+	expect(do(t, s, "DELETE", "/a", url.Values{"rev": {string(rev)}}), 409)
+	e := s.Entries()["/a"]
+	if string(e.Value) != "2" || string(e.Rev) == string(rev) {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	expect(do(t, s, "DELETE", "/a", url.Values{"rev": {string(e.Rev)}}), 200)
+	expect(do(t, s, "PUT", "/dir/", url.Values{"value": {"1"}}), 405)
+
+	c := s.Client()
+	for _, p := range []string{"/d/a", "/d/sub/b", "/dd/c"} {
+		if err := c.Set(p, []byte(p), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := c.ListAllChildren("/d/")
+	if err != nil || len(l) != 2 || l[0].Path != "/d/a" ||
+		l[1].Path != "/d/sub/b" {
+		t.Fatalf("unexpected children: %v %v", l, err)
+	}
+	if err := c.RecursiveDelete("/d/"); err != nil {
+		t.Fatal(err)
+	}
+	entries := s.Entries()
+	if len(entries) != 1 || entries["/dd/c"].Value == nil {
+		t.Fatalf("unexpected entries after recursive delete: %v", entries)
+	}
+	if err := c.Delete("/d/a", nil); err != metakv.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	s := newServer(t, nil)
+	c := s.Client()
+	if err := c.Set("/f/a", []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan metakv.KVEntry, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.RunObserveChildrenContext(ctx, "/f/",
+			func(e metakv.KVEntry) error {
+				ch <- e
+				return nil
+			})
+	}()
+	expect := func(path, value string) {
+		t.Helper()
+		select {
+		case e := <-ch:
+			if e.Path != path || string(e.Value) != value ||
+				value == "" && e.Value != nil {
+				t.Fatalf("expected %s=%s, got %v", path, value, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", path)
+		}
+	}
+
+	expect("/f/a", "1")
+	if err := c.Set("/other", []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSensitive("/f/b", []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expect("/f/b", "2")
+	if err := c.Delete("/f/a", nil); err != nil {
+		t.Fatal(err)
+	}
+	expect("/f/a", "")
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metakv.json")
+
+	s, err := NewServer(NewFileStorage(path))
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	c := s.Client()
+	if err := c.Set("/a", []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddSensitive("/s", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	_, rev, _ := c.Get("/a")
+	s.Close()
+
+	s = newServer(t, NewFileStorage(path))
+	c = s.Client()
+	v, rev2, err := c.Get("/a")
+	if err != nil || string(v) != "1" ||
+		string(rev2.([]byte)) != string(rev.([]byte)) {
+		t.Fatalf("unexpected value after reload: %s %v %v", v, rev2, err)
+	}
+	if !s.Entries()["/s"].Sensitive {
+		t.Fatalf("sensitive flag is lost")
+	}
+	if err := c.Set("/a", []byte("2"), rev2); err != nil {
+		t.Fatal(err)
+	}
+	_, rev3, _ := c.Get("/a")
+	if string(rev3.([]byte)) == string(rev.([]byte)) {
+		t.Fatalf("revision was reused after reload")
+	}
+}
+
+func TestCloseDisconnectsFeeds(t *testing.T) {
+	s, err := NewServer(nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	c := s.Client()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.RunObserveChildrenContext(context.Background(), "/",
+			func(metakv.KVEntry) error { return nil })
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatalf("expected feed error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("feed was not disconnected")
+	}
+}
+
+func TestElect(t *testing.T) {
+	s := newServer(t, nil)
+	opts := &metakv.LeaseOptions{TTL: 300 * time.Millisecond}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	leader1, err := s.Client().Elect(ctx1, "/leader", opts)
+	if err != nil {
+		t.Fatalf("Elect failed: %v", err)
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	elected := make(chan context.Context, 1)
+	go func() {
+		leader2, err := s.Client().Elect(ctx2, "/leader", opts)
+		if err != nil {
+			t.Errorf("Elect failed: %v", err)
+		}
+		elected <- leader2
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("second leader elected while first is alive")
+	case <-leader1.Done():
+		t.Fatal("first leader lost leadership")
+	case <-time.After(time.Second):
+	}
+
+	cancel1()
+	select {
+	case leader2 := <-elected:
+		if leader2.Err() != nil {
+			t.Fatalf("second leader is already done: %v", leader2.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second leader wasn't elected")
+	}
+}
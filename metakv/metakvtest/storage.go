@@ -0,0 +1,108 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakvtest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Entry is stored value of metakv key.
+type Entry struct {
+	Value     []byte `json:"value"`
+	Rev       []byte `json:"rev"`
+	Sensitive bool   `json:"sensitive,omitempty"`
+}
+
+// State is whole contents of Handler.
+type State struct {
+	// Rev is the last assigned revision number.
+	Rev     uint64           `json:"rev"`
+	Entries map[string]Entry `json:"entries"`
+}
+
+// Storage persists State of Handler. Save is called after every
+// mutation with the lock of handler held, so State must not be
+// retained.
+type Storage interface {
+	// Load returns saved state, or nil if nothing was saved yet.
+	Load() (*State, error)
+	Save(state *State) error
+}
+
+type memoryStorage struct{}
+
+// NewMemoryStorage returns Storage that doesn't persist anything.
+func NewMemoryStorage() Storage {
+	return memoryStorage{}
+}
+
+func (memoryStorage) Load() (*State, error) { return nil, nil }
+func (memoryStorage) Save(*State) error     { return nil }
+
+type fileStorage struct {
+	path string
+}
+
+// NewFileStorage returns Storage that keeps state in given json file.
+// File is replaced atomically on every save.
+func NewFileStorage(path string) Storage {
+	return fileStorage{path}
+}
+
+func (s fileStorage) Load() (*State, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s fileStorage) Save(state *State) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path),
+		filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
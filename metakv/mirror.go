@@ -0,0 +1,305 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMirrorClosed is returned by WaitSynced when mirror is closed
+// before it synced.
+var ErrMirrorClosed = errors.New("metakv mirror is closed")
+
+// MirrorChange describes change of a key observed by Mirror.
+type MirrorChange struct {
+	Path string
+	// Old is the previous entry, nil if the key was created.
+	Old *KVEntry
+	// New is the current entry, nil if the key was deleted.
+	New *KVEntry
+}
+
+// MirrorStats describe how up to date Mirror is.
+type MirrorStats struct {
+	// Synced is true when mirror is consistent with metakv, i.e.
+	// initial load is done and the feed is connected.
+	Synced bool
+	// Reconnects is how many times mirror resynced after losing
+	// the feed.
+	Reconnects uint64
+	// Changes is how many changes were applied.
+	Changes uint64
+	// Lag is how long mirror has been out of sync. It's zero when
+	// mirror is synced.
+	Lag time.Duration
+	// LastChange is when the last change was applied.
+	LastChange time.Time
+	// LastErr is the error that broke the feed most recently.
+	LastErr error
+}
+
+type mirrorSubscriber struct {
+	path string
+	fn   func(MirrorChange)
+}
+
+func (s *mirrorSubscriber) matches(path string) bool {
+	if strings.HasSuffix(s.path, "/") {
+		return strings.HasPrefix(path, s.path)
+	}
+	return path == s.path
+}
+
+// Mirror keeps in-memory copy of metakv directory up to date using
+// Watch. Get and List are served from immutable snapshot that is
+// replaced on every change, so they never block on ns_server.
+type Mirror struct {
+	dirpath string
+	clock   Clock
+
+	snapshot atomic.Value // map[string]KVEntry
+	synced   chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+
+	// entries and pending are only accessed by watch goroutine
+	entries map[string]KVEntry
+	pending []MirrorChange
+
+	l            sync.Mutex
+	subscribers  map[uint64]*mirrorSubscriber
+	subscriberID uint64
+	stats        MirrorStats
+	lostSync     time.Time
+}
+
+// NewMirror starts mirroring given directory of metakv that c talks
+// to. Opts configure underlying Watch and may be nil. Mirror must be
+// closed when it's not needed anymore. Path must end on "/".
+func NewMirror(c *Client, dirpath string, opts *WatchOptions) *Mirror {
+	assertValidDirPath(dirpath)
+	o := opts.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mirror{
+		dirpath: dirpath,
+		clock:   o.Clock,
+		synced:  make(chan struct{}),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		entries: make(map[string]KVEntry),
+	}
+	m.lostSync = o.Clock.Now()
+	m.snapshot.Store(map[string]KVEntry{})
+
+	go func() {
+		defer close(m.done)
+		err := c.Watch(ctx, dirpath, m.handle, &o)
+		if err != context.Canceled {
+			m.err = err
+		}
+	}()
+	return m
+}
+
+// Close stops mirroring. Snapshot stays available.
+func (m *Mirror) Close() error {
+	m.cancel()
+	<-m.done
+	return m.err
+}
+
+func (m *Mirror) publish() {
+	snapshot := make(map[string]KVEntry, len(m.entries))
+	for k, v := range m.entries {
+		snapshot[k] = v
+	}
+	m.snapshot.Store(snapshot)
+}
+
+func (m *Mirror) notify(changes []MirrorChange) {
+	m.l.Lock()
+	ids := make([]uint64, 0, len(m.subscribers))
+	for id := range m.subscribers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	subscribers := make([]*mirrorSubscriber, 0, len(ids))
+	for _, id := range ids {
+		subscribers = append(subscribers, m.subscribers[id])
+	}
+	m.l.Unlock()
+
+	for _, ch := range changes {
+		for _, s := range subscribers {
+			if s.matches(ch.Path) {
+				s.fn(ch)
+			}
+		}
+	}
+}
+
+func (m *Mirror) handle(ev WatchEvent) error {
+	now := m.clock.Now()
+	switch ev.Type {
+	case EventChange:
+		e := ev.Entry
+		ch := MirrorChange{Path: e.Path}
+		if old, ok := m.entries[e.Path]; ok {
+			ch.Old = &old
+		}
+		if e.Value == nil {
+			delete(m.entries, e.Path)
+		} else {
+			m.entries[e.Path] = e
+			ch.New = &e
+		}
+
+		m.l.Lock()
+		m.stats.Changes++
+		m.stats.LastChange = now
+		synced := m.stats.Synced
+		m.l.Unlock()
+
+		if !synced {
+			// published together with the rest of resync
+			m.pending = append(m.pending, ch)
+			return nil
+		}
+		m.publish()
+		m.notify([]MirrorChange{ch})
+
+	case EventResynced:
+		m.publish()
+		m.l.Lock()
+		if m.isSynced() {
+			m.stats.Reconnects++
+		}
+		m.stats.Synced = true
+		m.l.Unlock()
+		select {
+		case <-m.synced:
+		default:
+			close(m.synced)
+		}
+		pending := m.pending
+		m.pending = nil
+		m.notify(pending)
+
+	case EventDisconnected:
+		m.l.Lock()
+		m.stats.Synced = false
+		m.stats.LastErr = ev.Err
+		m.lostSync = now
+		m.l.Unlock()
+	}
+	return nil
+}
+
+// isSynced returns true if mirror synced at least once.
+func (m *Mirror) isSynced() bool {
+	select {
+	case <-m.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitSynced waits until initial load of the directory is done.
+// Returns ctx.Err() if ctx gets done first and ErrMirrorClosed if
+// mirror is closed before syncing.
+func (m *Mirror) WaitSynced(ctx context.Context) error {
+	select {
+	case <-m.synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.done:
+		if m.isSynced() {
+			return nil
+		}
+		if m.err != nil {
+			return m.err
+		}
+		return ErrMirrorClosed
+	}
+}
+
+// Snapshot returns current contents of the directory keyed by path.
+// Returned map must not be modified.
+func (m *Mirror) Snapshot() map[string]KVEntry {
+	return m.snapshot.Load().(map[string]KVEntry)
+}
+
+// Get returns entry of given key and whether it exists. Value of the
+// entry must not be modified.
+func (m *Mirror) Get(path string) (KVEntry, bool) {
+	e, ok := m.Snapshot()[path]
+	return e, ok
+}
+
+// List returns all entries of the directory sorted by path. Values of
+// the entries must not be modified.
+func (m *Mirror) List() []KVEntry {
+	snapshot := m.Snapshot()
+	rv := make([]KVEntry, 0, len(snapshot))
+	for _, e := range snapshot {
+		rv = append(rv, e)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Path < rv[j].Path })
+	return rv
+}
+
+// Subscribe registers function that is called on every change of given
+// key or, if path ends on "/", of every key under it. Changes are
+// delivered one at a time in the order they were applied, after they
+// are visible via Get. Changes made while mirror was out of sync are
+// delivered once it resyncs. Returned function unsubscribes.
+func (m *Mirror) Subscribe(path string, fn func(MirrorChange)) (unsubscribe func()) {
+	assertValidPathPrefix(path)
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.subscribers == nil {
+		m.subscribers = make(map[uint64]*mirrorSubscriber)
+	}
+	m.subscriberID++
+	id := m.subscriberID
+	m.subscribers[id] = &mirrorSubscriber{path, fn}
+	return func() {
+		m.l.Lock()
+		delete(m.subscribers, id)
+		m.l.Unlock()
+	}
+}
+
+// Stats returns statistics of the mirror.
+func (m *Mirror) Stats() MirrorStats {
+	now := m.clock.Now()
+	m.l.Lock()
+	defer m.l.Unlock()
+	rv := m.stats
+	if !rv.Synced {
+		rv.Lag = now.Sub(m.lostSync)
+	}
+	return rv
+}
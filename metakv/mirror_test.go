@@ -0,0 +1,161 @@
+package metakv
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/utils"
+)
+
+func changeString(ch MirrorChange) string {
+	s := ch.Path + ":"
+	if ch.Old != nil {
+		s += string(ch.Old.Value)
+	}
+	s += "->"
+	if ch.New != nil {
+		s += string(ch.New.Value)
+	}
+	return s
+}
+
+func expectChanges(t *testing.T, ch chan string, expected ...string) {
+	t.Helper()
+	for _, exp := range expected {
+		select {
+		case got := <-ch:
+			if got != exp {
+				t.Fatalf("expected change %s, got %s", exp, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change %s", exp)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	kv, writer := newMockClient(t)
+	c, broken := newBreakableClient(t, kv)
+	must(t).ok(writer.Set("/m/a", []byte("1"), nil))
+	must(t).ok(writer.Set("/m/b", []byte("2"), nil))
+
+	clock := newFakeClock()
+	m := NewMirror(c, "/m/", &WatchOptions{
+		Backoff: utils.Backoff{
+			Initial: 10 * time.Second,
+			Int63n:  func(n int64) int64 { return n - 1 },
+		},
+		Clock: clock,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	must(t).ok(m.WaitSynced(ctx))
+
+	if e, ok := m.Get("/m/a"); !ok || string(e.Value) != "1" {
+		t.Fatalf("unexpected /m/a: %v %v", e, ok)
+	}
+	if l := m.List(); len(l) != 2 || l[0].Path != "/m/a" ||
+		l[1].Path != "/m/b" {
+		t.Fatalf("unexpected list: %v", l)
+	}
+	st := m.Stats()
+	if !st.Synced || st.Changes != 2 || st.Lag != 0 || st.Reconnects != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	keyChanges := make(chan string, 16)
+	allChanges := make(chan string, 16)
+	m.Subscribe("/m/a", func(ch MirrorChange) {
+		if e, _ := m.Get("/m/a"); string(e.Value) != string(ch.New.Value) {
+			t.Errorf("change is not visible via Get: %v", e)
+		}
+		keyChanges <- changeString(ch)
+	})
+	unsubscribe := m.Subscribe("/m/", func(ch MirrorChange) {
+		allChanges <- changeString(ch)
+	})
+
+	must(t).ok(writer.Set("/m/a", []byte("10"), nil))
+	must(t).ok(writer.Set("/m/c", []byte("3"), nil))
+	expectChanges(t, keyChanges, "/m/a:1->10")
+	expectChanges(t, allChanges, "/m/a:1->10", "/m/c:->3")
+
+	atomic.StoreInt32(broken, 1)
+	kv.dropConns()
+	waitFor(t, "mirror to lose sync", func() bool {
+		return !m.Stats().Synced
+	})
+	clock.waitTimers(t, 1)
+	clock.Advance(3 * time.Second)
+	st = m.Stats()
+	if st.Lag != 3*time.Second || st.LastErr == nil {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	must(t).ok(writer.Delete("/m/b", nil))
+	atomic.StoreInt32(broken, 0)
+	clock.Advance(7 * time.Second)
+	expectChanges(t, allChanges, "/m/b:2->")
+	waitFor(t, "mirror to resync", func() bool {
+		return m.Stats().Synced
+	})
+	st = m.Stats()
+	if st.Reconnects != 1 || st.Lag != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if _, ok := m.Get("/m/b"); ok {
+		t.Fatalf("/m/b must be deleted")
+	}
+
+	unsubscribe()
+	must(t).ok(writer.Set("/m/d", []byte("4"), nil))
+	waitFor(t, "/m/d", func() bool {
+		_, ok := m.Get("/m/d")
+		return ok
+	})
+	select {
+	case ch := <-allChanges:
+		t.Fatalf("unexpected change after unsubscribe: %s", ch)
+	default:
+	}
+
+	must(t).ok(m.Close())
+	must(t).ok(m.WaitSynced(context.Background()))
+	if len(m.List()) != 3 {
+		t.Fatalf("snapshot must survive Close: %v", m.List())
+	}
+}
+
+func TestMirrorNeverSynced(t *testing.T) {
+	kv, _ := newMockClient(t)
+	c, broken := newBreakableClient(t, kv)
+	atomic.StoreInt32(broken, 1)
+	m := NewMirror(c, "/m/", &WatchOptions{Clock: newFakeClock()})
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if err := m.WaitSynced(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := m.WaitSynced(context.Background()); err != ErrMirrorClosed {
+		t.Fatalf("expected ErrMirrorClosed, got: %v", err)
+	}
+}
@@ -2,16 +2,21 @@ package metakv
 
 import (
 	"fmt"
+	"time"
 )
 
+// sanityFeedTimeout is how long sanity test waits for expected
+// mutations to show up on observe feed.
+const sanityFeedTimeout = 10 * time.Second
+
 func noPanic(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
-func doAppend(s *store, path string, value string, sensitive bool) error {
-	oldv, rev, err := s.get(path)
+func doAppend(c *Client, path string, value string, sensitive bool) error {
+	oldv, rev, err := c.Get(path)
 	if err != nil {
 		return err
 	}
@@ -19,7 +24,10 @@ func doAppend(s *store, path string, value string, sensitive bool) error {
 		rev = RevCreate
 	}
 	oldv = append(oldv, []byte(value)...)
-	return s.set(path, oldv, rev, sensitive)
+	if sensitive {
+		return c.SetSensitive(path, oldv, rev)
+	}
+	return c.Set(path, oldv, rev)
 }
 
 func kvEqual(e kvEntry, key string, val []byte, sensitive bool) bool {
@@ -42,33 +50,36 @@ func assertKV(log func(v ...interface{}), e kvEntry, key string, val []byte,
 	}
 }
 
-func assertAndDelete(s *store, key string, val string) {
-	v, r, err := s.get(key)
+func assertAndDelete(c *Client, key string, val string) {
+	v, r, err := c.Get(key)
 	noPanic(err)
 	if r == nil || string(v) != val {
 		panic(fmt.Sprintf("wrong value: %v", string(v)))
 	}
 
-	err = s.delete(key, r)
+	err = c.Delete(key, r)
 	noPanic(err)
 }
 
 // ExecuteBasicSanityTest runs basic sanity test.
 func ExecuteBasicSanityTest(log func(v ...interface{})) {
-	doExecuteBasicSanityTest(log, defaultStore)
+	defaultClient.ExecuteBasicSanityTest(log)
 }
 
-func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
+// ExecuteBasicSanityTest runs basic sanity test against metakv that
+// client talks to. Panics if metakv misbehaves. Everything under
+// "/_sanity/" is deleted.
+func (c *Client) ExecuteBasicSanityTest(log func(v ...interface{})) {
 	log("Starting basic sanity test")
-	l, err := s.listAllChildren("/_sanity/")
+	l, err := c.ListAllChildren("/_sanity/")
 	noPanic(err)
 	for _, kve := range l {
-		err := s.delete(kve.Path, nil)
+		err := c.Delete(kve.Path, nil)
 		noPanic(err)
 	}
 	log("cleaned up /_sanity/ subspace")
 
-	v, r, err := s.get("/_sanity/nonexistant")
+	v, r, err := c.Get("/_sanity/nonexistant")
 	noPanic(err)
 	if v != nil || r != nil {
 		panic("badness")
@@ -84,7 +95,7 @@ func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
 	}()
 
 	go func() {
-		err := s.runObserveChildren("/_sanity/", func(e kvEntry) error {
+		err := c.runObserveChildren("/_sanity/", func(e kvEntry) error {
 			buf <- e
 			return nil
 		}, cancelChan)
@@ -95,39 +106,55 @@ func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
 		}
 	}()
 
-	err = doAppend(s, "/_sanity/key", "value", false)
+	err = doAppend(c, "/_sanity/key", "value", false)
 	noPanic(err)
 
-	v, r, err = s.get("/_sanity/key")
+	v, r, err = c.Get("/_sanity/key")
 	noPanic(err)
 	if r == nil || string(v) != "value" {
 		panic("badness")
 	}
 
-	err = s.set("/_sanity/key", []byte("new value"), r, false)
+	err = c.Set("/_sanity/key", []byte("new value"), r)
 	noPanic(err)
 
-	err = doAppend(s, "/_sanity/secret", "secret", true)
+	err = doAppend(c, "/_sanity/secret", "secret", true)
 	noPanic(err)
 
-	err = s.delete("/_sanity/key", r)
+	err = c.Delete("/_sanity/key", r)
 	if err != ErrRevMismatch {
 		panic("must have ErrRevMismatch")
 	}
 
-	assertAndDelete(s, "/_sanity/secret", "secret")
-	assertAndDelete(s, "/_sanity/key", "new value")
+	assertAndDelete(c, "/_sanity/secret", "secret")
+	assertAndDelete(c, "/_sanity/key", "new value")
 
-	l, err = s.listAllChildren("/_sanity/")
+	l, err = c.ListAllChildren("/_sanity/")
 	noPanic(err)
 	if len(l) != 0 {
 		panic("len is bad")
 	}
 
+	// mutations may still be in flight on the feed, so wait for them
+	// before cancelling it or they are lost with the connection
+	var allMutations []kvEntry
+	timeout := time.After(sanityFeedTimeout)
+collect:
+	for len(allMutations) < 5 {
+		select {
+		case kve, ok := <-buf:
+			if !ok {
+				break collect
+			}
+			allMutations = append(allMutations, kve)
+		case <-timeout:
+			break collect
+		}
+	}
+
 	close(cancelChan)
 	cancelChan = nil
 
-	var allMutations []kvEntry
 	for kve := range buf {
 		allMutations = append(allMutations, kve)
 	}
@@ -145,16 +172,16 @@ func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
 	assertKV(log, allMutations[3], "/_sanity/secret", nil, false)
 	assertKV(log, allMutations[4], "/_sanity/key", nil, false)
 
-	err = s.set("/_sanity/key", []byte("more value"), nil, false)
+	err = c.Set("/_sanity/key", []byte("more value"), nil)
 	noPanic(err)
-	v, r, err = s.get("/_sanity/key")
+	v, r, err = c.Get("/_sanity/key")
 	noPanic(err)
 	if r == nil || string(v) != "more value" {
 		panic("expecting more value got: " + string(v))
 	}
-	err = s.delete("/_sanity/key", nil)
+	err = c.Delete("/_sanity/key", nil)
 	noPanic(err)
-	_, r, err = s.get("/_sanity/key")
+	_, r, err = c.Get("/_sanity/key")
 	noPanic(err)
 	if r != nil {
 		panic("expected key to be missing after successful delete")
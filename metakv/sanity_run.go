@@ -3,16 +3,17 @@ package metakv
 import (
 	"os"
 
-	log "github.com/couchbase/clog"
+	"github.com/couchbase/cbauth/logging"
 )
 
 func init() {
 	if os.Getenv("COUCHBASE_METAKV_SANITY") != "" {
-		ExecuteBasicSanityTest(log.Print)
+		ExecuteBasicSanityTest(logging.PrintFunc(logging.LevelInfo))
 	}
 
 	if l := os.Getenv("COUCHBASE_METAKV_DEBUG"); l != "" {
-		log.Printf("Starting _metakv debugging endpoint on `%s'", l)
+		logging.Info("metakv: starting _metakv debugging endpoint",
+			"addr", l)
 		GoRunDebugEndpoint(l)
 	}
 }
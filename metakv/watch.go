@@ -0,0 +1,325 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/couchbase/cbauth/logging"
+	"github.com/couchbase/cbauth/utils"
+)
+
+// WatchEventType is type of WatchEvent.
+type WatchEventType int
+
+const (
+	// EventChange signals that key was created, updated or, if
+	// Entry.Value is nil, deleted.
+	EventChange WatchEventType = iota
+	// EventResynced signals that all changes up to the moment of
+	// (re)connection were delivered, i.e. callback's view of the
+	// directory is consistent with metakv. It follows the initial
+	// snapshot and every reconnection.
+	EventResynced
+	// EventDisconnected signals that feed broke after resync and
+	// Watch is about to reconnect. Changes are not delivered until
+	// next EventResynced.
+	EventDisconnected
+)
+
+func (t WatchEventType) String() string {
+	switch t {
+	case EventChange:
+		return "change"
+	case EventResynced:
+		return "resynced"
+	case EventDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// WatchEvent is passed to WatchCallback.
+type WatchEvent struct {
+	Type WatchEventType
+	// Entry is the changed entry. It's only set for EventChange.
+	Entry KVEntry
+	// Err is the error that broke the feed. It's only set for
+	// EventDisconnected.
+	Err error
+}
+
+// WatchCallback receives events from Watch.
+type WatchCallback func(ev WatchEvent) error
+
+// WatchOptions configure Watch. Zero fields take default values.
+type WatchOptions struct {
+	// Backoff paces reconnections. Zero Backoff.Initial and
+	// Backoff.Max mean 100ms and 30s.
+	Backoff utils.Backoff
+	// HealthyPeriod is how long feed needs to stay up after resync
+	// for backoff to start over from Backoff.Initial. Default is 1m.
+	HealthyPeriod time.Duration
+	// Clock, if non-nil, replaces real time.
+	Clock Clock
+}
+
+func (o *WatchOptions) withDefaults() WatchOptions {
+	var rv WatchOptions
+	if o != nil {
+		rv = *o
+	}
+	if rv.Backoff.Initial <= 0 {
+		rv.Backoff.Initial = 100 * time.Millisecond
+	}
+	if rv.Backoff.Max <= 0 {
+		rv.Backoff.Max = 30 * time.Second
+	}
+	if rv.Backoff.Max < rv.Backoff.Initial {
+		rv.Backoff.Max = rv.Backoff.Initial
+	}
+	if rv.HealthyPeriod <= 0 {
+		rv.HealthyPeriod = time.Minute
+	}
+	if rv.Clock == nil {
+		rv.Clock = utils.RealClock{}
+	}
+	return rv
+}
+
+type callbackError struct {
+	err error
+}
+
+func (e *callbackError) Error() string {
+	return e.err.Error()
+}
+
+type watcher struct {
+	c        *Client
+	dirpath  string
+	callback WatchCallback
+	// revs are revisions of keys as last delivered to callback
+	revs map[string][]byte
+	// snapshot holds revisions that keys had in the snapshot of last
+	// resync, until feed catches up with it. Feed is opened before
+	// the snapshot is read, so it may start with older events.
+	snapshot map[string][]byte
+	// current is set of keys of the snapshot which feed already
+	// delivered snapshot revision of.
+	current map[string]bool
+}
+
+func (w *watcher) deliver(e kvEntry) error {
+	rev, known := w.revs[e.Path]
+	if e.Value == nil {
+		if !known {
+			return nil
+		}
+		delete(w.revs, e.Path)
+	} else {
+		if known && bytes.Equal(rev, e.Rev) {
+			return nil
+		}
+		w.revs[e.Path] = e.Rev
+	}
+	err := w.callback(WatchEvent{
+		Type:  EventChange,
+		Entry: KVEntry{e.Path, e.Value, e.Rev, e.Sensitive},
+	})
+	if err != nil {
+		return &callbackError{err}
+	}
+	return nil
+}
+
+// deliverFeed delivers feed event unless feed is still behind the
+// snapshot of last resync.
+func (w *watcher) deliverFeed(ctx context.Context, e kvEntry) error {
+	if w.snapshot != nil {
+		behind, err := w.behind(ctx, e)
+		if err != nil || behind {
+			return err
+		}
+	}
+	return w.deliver(e)
+}
+
+func (w *watcher) caughtUp() {
+	w.snapshot = nil
+	w.current = nil
+}
+
+// behind returns true if feed event is older than the snapshot. Once
+// feed delivers a change made after the snapshot, all the following
+// events are newer too, and so checking stops.
+func (w *watcher) behind(ctx context.Context, e kvEntry) (bool, error) {
+	if rev, ok := w.snapshot[e.Path]; ok {
+		if w.current[e.Path] {
+			// the change that follows snapshot revision
+			if e.Value == nil || !bytes.Equal(rev, e.Rev) {
+				w.caughtUp()
+			}
+			return false, nil
+		}
+		if e.Value != nil && bytes.Equal(rev, e.Rev) {
+			w.current[e.Path] = true
+			return false, nil
+		}
+		return true, nil
+	}
+
+	// the key is missing in the snapshot, so callback doesn't know
+	// about it and its deletion wouldn't be delivered anyway
+	if e.Value == nil {
+		return false, nil
+	}
+	// if the key has the value of the event now, then it was created
+	// after the snapshot. Otherwise feed will deliver following
+	// changes of the key later
+	_, rev, err := w.c.GetContext(ctx, e.Path)
+	if err != nil {
+		return false, err
+	}
+	if rev != nil && bytes.Equal(rev.([]byte), e.Rev) {
+		w.caughtUp()
+		return false, nil
+	}
+	return true, nil
+}
+
+// resync opens continuous feed and then brings callback's view in line
+// with snapshot of the directory that is read after the feed is open.
+// That way nothing that happens after the snapshot is missed. Feed
+// events that predate the snapshot are then skipped by deliverFeed.
+// Returned feed is to be read by readObserveChildren.
+func (w *watcher) resync(ctx context.Context) (*http.Response, error) {
+	feed, err := openObserveChildren(ctx, w.c, w.dirpath, true)
+	if err != nil {
+		return nil, err
+	}
+	err = w.deliverSnapshot(ctx)
+	if err != nil {
+		feed.Body.Close()
+		return nil, err
+	}
+	return feed, nil
+}
+
+func (w *watcher) deliverSnapshot(ctx context.Context) error {
+	w.snapshot = make(map[string][]byte, len(w.revs))
+	w.current = make(map[string]bool)
+	err := doRunObserveChildren(ctx, w.c, w.dirpath,
+		func(e kvEntry) error {
+			w.snapshot[e.Path] = e.Rev
+			return w.deliver(e)
+		}, false)
+	if err != nil {
+		return err
+	}
+
+	var vanished []string
+	for path := range w.revs {
+		if _, ok := w.snapshot[path]; !ok {
+			vanished = append(vanished, path)
+		}
+	}
+	sort.Strings(vanished)
+	for _, path := range vanished {
+		err = w.deliver(kvEntry{Path: path})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.callback(WatchEvent{Type: EventResynced})
+	if err != nil {
+		return &callbackError{err}
+	}
+	return nil
+}
+
+// Watch is resilient RunObserveChildren. It invokes callback on every
+// kv-pair that is child of given directory path, then signals
+// EventResynced and then invokes callback on every mutation. When
+// feed breaks, Watch reconnects with backoff and resyncs: only keys
+// that changed while it was disconnected are delivered, keys that
+// vanished are delivered as deletions and then EventResynced is
+// signalled again. Loss of the feed after resync is signalled by
+// EventDisconnected. Mutations that don't change revision of a key are
+// never delivered, and neither are mutations that are older than
+// what was delivered at resync, so keys never go back to older values.
+//
+// Returns ctx.Err() when ctx is done or error returned by callback.
+// Path must end on "/".
+func (c *Client) Watch(ctx context.Context, dirpath string,
+	callback WatchCallback, opts *WatchOptions) error {
+	assertValidDirPath(dirpath)
+	o := opts.withDefaults()
+	w := &watcher{
+		c:        c,
+		dirpath:  dirpath,
+		callback: callback,
+		revs:     make(map[string][]byte),
+	}
+
+	backoff := o.Backoff
+	for {
+		synced := false
+		var syncedAt time.Time
+		feed, err := w.resync(ctx)
+		if err == nil {
+			synced = true
+			syncedAt = o.Clock.Now()
+			err = readObserveChildren(ctx, feed,
+				func(e kvEntry) error {
+					return w.deliverFeed(ctx, e)
+				}, true)
+		}
+		if cerr, ok := err.(*callbackError); ok {
+			return cerr.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if synced {
+			if o.Clock.Now().Sub(syncedAt) >= o.HealthyPeriod {
+				backoff.Reset()
+			}
+			cerr := callback(WatchEvent{Type: EventDisconnected, Err: err})
+			if cerr != nil {
+				return cerr
+			}
+		}
+		sleep := backoff.Next()
+		logging.Warn("metakv: watch failed, will reconnect",
+			"path", dirpath, "err", err, "backoff", sleep)
+		if utils.Sleep(ctx, o.Clock, sleep) != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Watch is Client.Watch of default client.
+func Watch(ctx context.Context, dirpath string, callback WatchCallback,
+	opts *WatchOptions) error {
+	return defaultClient.Watch(ctx, dirpath, callback, opts)
+}
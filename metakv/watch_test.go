@@ -0,0 +1,221 @@
+package metakv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/utils"
+)
+
+func expectEvents(t *testing.T, ch chan WatchEvent, expected ...string) {
+	t.Helper()
+	for _, exp := range expected {
+		select {
+		case ev := <-ch:
+			got := ev.Type.String()
+			if ev.Type == EventChange {
+				got = fmt.Sprintf("%s=%s", ev.Entry.Path,
+					ev.Entry.Value)
+				if ev.Entry.Value == nil {
+					got = "-" + ev.Entry.Path
+				}
+			}
+			if got != exp {
+				t.Fatalf("expected event %s, got %s", exp, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %s", exp)
+		}
+	}
+}
+
+func expectNoEvents(t *testing.T, ch chan WatchEvent) {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event: %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatch(t *testing.T) {
+	kv, _ := newMockClient(t)
+	c, broken := newBreakableClient(t, kv)
+	must(t).ok(c.Set("/w/a", []byte("1"), nil))
+	must(t).ok(c.Set("/w/b", []byte("2"), nil))
+
+	clock := newFakeClock()
+	opts := &WatchOptions{
+		Backoff: utils.Backoff{
+			Initial: time.Second,
+			Max:     4 * time.Second,
+			Int63n:  func(n int64) int64 { return n - 1 },
+		},
+		HealthyPeriod: time.Minute,
+		Clock:         clock,
+	}
+
+	events := make(chan WatchEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Watch(ctx, "/w/", func(ev WatchEvent) error {
+			events <- ev
+			return nil
+		}, opts)
+	}()
+
+	expectEvents(t, events, "/w/a=1", "/w/b=2", "resynced")
+	must(t).ok(c.Set("/w/c", []byte("3"), nil))
+	expectEvents(t, events, "/w/c=3")
+	expectNoEvents(t, events)
+
+	// make watch fail and mutate the directory while it's disconnected
+	kv.dropConns()
+	expectEvents(t, events, "disconnected")
+	clock.waitTimers(t, 1)
+	must(t).ok(c.Set("/w/a", []byte("10"), nil))
+	must(t).ok(c.Delete("/w/b", nil))
+	must(t).ok(c.Set("/w/d", []byte("4"), nil))
+	expectNoEvents(t, events)
+
+	clock.Advance(time.Second)
+	expectEvents(t, events, "/w/a=10", "/w/d=4", "-/w/b", "resynced")
+	expectNoEvents(t, events)
+
+	must(t).ok(c.Delete("/w/c", nil))
+	expectEvents(t, events, "-/w/c")
+
+	// feed broke soon after resync, so backoff keeps growing
+	atomic.StoreInt32(broken, 1)
+	kv.dropConns()
+	expectEvents(t, events, "disconnected")
+	clock.waitTimers(t, 1)
+	clock.Advance(2 * time.Second)
+	clock.waitTimers(t, 1)
+	clock.Advance(4*time.Second - time.Nanosecond)
+	expectNoEvents(t, events)
+	atomic.StoreInt32(broken, 0)
+	clock.Advance(time.Nanosecond)
+	expectEvents(t, events, "resynced")
+
+	// and it starts over once feed stays up for HealthyPeriod
+	clock.Advance(time.Minute)
+	kv.dropConns()
+	expectEvents(t, events, "disconnected")
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Second)
+	expectEvents(t, events, "resynced")
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestWatchDeletionWhileReconnecting(t *testing.T) {
+	kv, writer := newMockClient(t)
+	must(t).ok(writer.Set("/w/a", []byte("1"), nil))
+	must(t).ok(writer.Set("/w/b", []byte("2"), nil))
+
+	// /w/b is deleted right before continuous feed is requested on
+	// reconnection
+	var armed int32
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("feed") == "continuous" &&
+			atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			kv.l.Lock()
+			kv.broadcast(KVEntry{Path: "/w/b"})
+			delete(kv.data, "/w/b")
+			kv.l.Unlock()
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	c, err := NewClient(kv.srv.URL, rt, nil)
+	must(t).ok(err)
+
+	clock := newFakeClock()
+	events := make(chan WatchEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, "/w/", func(ev WatchEvent) error {
+		events <- ev
+		return nil
+	}, &WatchOptions{Clock: clock})
+
+	expectEvents(t, events, "/w/a=1", "/w/b=2", "resynced")
+	atomic.StoreInt32(&armed, 1)
+	kv.dropConns()
+	expectEvents(t, events, "disconnected")
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Minute)
+	expectEvents(t, events, "-/w/b", "resynced")
+	expectNoEvents(t, events)
+}
+
+func TestWatchSkipsFeedEventsOlderThanSnapshot(t *testing.T) {
+	kv, writer := newMockClient(t)
+	must(t).ok(writer.Set("/w/a", []byte("1"), nil))
+
+	// /w/a is updated and /w/x comes and goes after continuous feed
+	// is opened but before snapshot is read
+	var armed int32 = 1
+	rt := rtFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Query().Get("feed") != "continuous" &&
+			strings.HasSuffix(req.URL.Path, "/w/") &&
+			atomic.CompareAndSwapInt32(&armed, 1, 0) {
+			kv.l.Lock()
+			kv.setLocked("/w/a", "2", false)
+			kv.setLocked("/w/x", "1", false)
+			kv.broadcast(KVEntry{Path: "/w/x"})
+			delete(kv.data, "/w/x")
+			kv.l.Unlock()
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	c, err := NewClient(kv.srv.URL, rt, nil)
+	must(t).ok(err)
+
+	events := make(chan WatchEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Watch(ctx, "/w/", func(ev WatchEvent) error {
+		events <- ev
+		return nil
+	}, nil)
+
+	expectEvents(t, events, "/w/a=2", "resynced")
+	expectNoEvents(t, events)
+
+	must(t).ok(writer.Set("/w/a", []byte("3"), nil))
+	must(t).ok(writer.Set("/w/x", []byte("2"), nil))
+	must(t).ok(writer.Delete("/w/x", nil))
+	expectEvents(t, events, "/w/a=3", "/w/x=2", "-/w/x")
+	expectNoEvents(t, events)
+}
+
+func TestWatchCallbackError(t *testing.T) {
+	_, c := newMockClient(t)
+	if err := c.Set("/w/a", []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cbErr := errors.New("callback error")
+	err := c.Watch(context.Background(), "/w/",
+		func(ev WatchEvent) error {
+			if ev.Type == EventResynced {
+				return cbErr
+			}
+			return nil
+		}, nil)
+	if err != cbErr {
+		t.Fatalf("expected callback error, got: %v", err)
+	}
+}
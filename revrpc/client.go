@@ -0,0 +1,211 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// ErrNotConnected is returned by Call if service is not connected to
+// ns_server or if connection was lost before reply was received.
+var ErrNotConnected = errors.New("revrpc service is not connected")
+
+// callIDPrefix distinguishes ids of our requests from ids that
+// ns_server uses for its requests.
+const callIDPrefix = "go-"
+
+type clientRequest struct {
+	Version string         `json:"jsonrpc,omitempty"`
+	Method  string         `json:"method"`
+	Params  [1]interface{} `json:"params"`
+	ID      string         `json:"id"`
+}
+
+type clientResponse struct {
+	Method *string          `json:"method"`
+	ID     json.RawMessage  `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+// muxConn multiplexes requests that ns_server sends to us and
+// replies to our own requests on single revrpc connection. Incoming
+// requests are passed to the server codec via Read. Writes of server
+// codec and of outbound calls are serialized.
+type muxConn struct {
+	rwc      io.ReadWriteCloser
+	jsonrpc2 bool
+
+	serverR *io.PipeReader
+	serverW *io.PipeWriter
+
+	wl sync.Mutex
+
+	l       sync.Mutex
+	seq     uint64
+	pending map[string]chan *clientResponse
+	closed  bool
+}
+
+func newMuxConn(rwc io.ReadWriteCloser, jsonrpc2 bool) *muxConn {
+	r, w := io.Pipe()
+	c := &muxConn{
+		rwc:      rwc,
+		jsonrpc2: jsonrpc2,
+		serverR:  r,
+		serverW:  w,
+		pending:  make(map[string]chan *clientResponse),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	return c.serverR.Read(p)
+}
+
+func (c *muxConn) Write(p []byte) (int, error) {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	return c.rwc.Write(p)
+}
+
+func (c *muxConn) Close() error {
+	return c.rwc.Close()
+}
+
+func (c *muxConn) readLoop() {
+	dec := json.NewDecoder(c.rwc)
+	for {
+		var msg json.RawMessage
+		err := dec.Decode(&msg)
+		if err != nil {
+			c.serverW.CloseWithError(err)
+			c.failPending()
+			return
+		}
+
+		var resp clientResponse
+		if json.Unmarshal(msg, &resp) == nil && resp.Method == nil {
+			c.deliver(&resp)
+			continue
+		}
+		_, err = c.serverW.Write(msg)
+		if err != nil {
+			c.failPending()
+			return
+		}
+	}
+}
+
+func (c *muxConn) deliver(resp *clientResponse) {
+	id, err := strconv.Unquote(string(resp.ID))
+	if err != nil {
+		return
+	}
+	c.l.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.l.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+func (c *muxConn) failPending() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.closed = true
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *muxConn) call(ctx context.Context, method string,
+	args interface{}, reply interface{}) error {
+	ch := make(chan *clientResponse, 1)
+
+	c.l.Lock()
+	if c.closed {
+		c.l.Unlock()
+		return ErrNotConnected
+	}
+	c.seq++
+	id := callIDPrefix + strconv.FormatUint(c.seq, 10)
+	c.pending[id] = ch
+	c.l.Unlock()
+
+	forget := func() {
+		c.l.Lock()
+		delete(c.pending, id)
+		c.l.Unlock()
+	}
+
+	req := clientRequest{Method: method, ID: id}
+	if c.jsonrpc2 {
+		req.Version = "2.0"
+	}
+	req.Params[0] = args
+	body, err := json.Marshal(&req)
+	if err != nil {
+		forget()
+		return err
+	}
+	_, err = c.Write(append(body, '\n'))
+	if err != nil {
+		forget()
+		return err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return ErrNotConnected
+		}
+		if resp.Error != nil {
+			return errorFromPeer(resp.Error)
+		}
+		if reply == nil || resp.Result == nil {
+			return nil
+		}
+		return json.Unmarshal(*resp.Result, reply)
+	case <-ctx.Done():
+		forget()
+		return ctx.Err()
+	}
+}
+
+// Call makes rpc call to ns_server over revrpc connection of running
+// service and waits for the reply until ctx is done. Returns
+// ErrNotConnected if service is not connected. Errors returned by
+// ns_server are returned as rpc.ServerError, or as *Error if
+// ns_server sends JSON-RPC 2.0 error object.
+func (s *Service) Call(ctx context.Context, method string,
+	args interface{}, reply interface{}) error {
+	s.l.Lock()
+	mux := s.mux
+	s.l.Unlock()
+	if mux == nil {
+		return ErrNotConnected
+	}
+	return mux.call(ctx, method, args, reply)
+}
@@ -0,0 +1,207 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/rpc"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/logging"
+)
+
+// Call describes rpc call that is seen by interceptors.
+type Call struct {
+	// Method is "Service.Method" name of the call.
+	Method string
+	// Start is when the request was received.
+	Start time.Time
+	// Args points to decoded arguments. It is set once the
+	// arguments are decoded, i.e. only after next handler returns.
+	Args interface{}
+	// Reply is reply of the handler. It is set once handler returns.
+	Reply interface{}
+
+	codec *singleCallCodec
+}
+
+// CallHandler handles rpc call. Returned error is sent to the caller.
+type CallHandler func(call *Call) error
+
+// ServerInterceptor is invoked for every rpc call that Service
+// handles. It is expected to call next to proceed with the call and
+// may inspect the call before and after that. Error returned by
+// interceptor is sent to the caller instead of handler's reply.
+type ServerInterceptor func(call *Call, next CallHandler) error
+
+// SetInterceptors sets interceptors for rpc calls. First interceptor
+// is the outermost one. Interceptors take effect on the next (re)start
+// of the service.
+func (s *Service) SetInterceptors(interceptors ...ServerInterceptor) {
+	s.l.Lock()
+	s.interceptors = append([]ServerInterceptor{}, interceptors...)
+	s.l.Unlock()
+}
+
+func chainInterceptors(interceptors []ServerInterceptor,
+	handler CallHandler) CallHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(call *Call) error {
+			return interceptor(call, next)
+		}
+	}
+	return handler
+}
+
+// singleCallCodec feeds single already read request to rpc.Server
+// and captures the response.
+type singleCallCodec struct {
+	call      *Call
+	params    json.RawMessage
+	paramsErr error
+	errMsg    string
+	reply     interface{}
+}
+
+func (c *singleCallCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = c.call.Method
+	r.Seq = 0
+	return nil
+}
+
+func (c *singleCallCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if c.paramsErr != nil {
+		return c.paramsErr
+	}
+	if len(c.params) != 0 {
+		err := json.Unmarshal(c.params, x)
+		if err != nil {
+			return err
+		}
+	}
+	c.call.Args = x
+	return nil
+}
+
+func (c *singleCallCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.errMsg = r.Error
+	c.reply = x
+	return nil
+}
+
+func (c *singleCallCodec) Close() error {
+	return nil
+}
+
+// invalidRequest is sent as reply together with errors, same as
+// net/rpc does.
+var invalidRequest = struct{}{}
+
+// serveCodecIntercepted is like server.ServeCodec but passes every
+// call through given interceptors. Each call is served by
+// server.ServeRequest, so that handlers run within interceptors.
+func serveCodecIntercepted(server *rpc.Server, codec rpc.ServerCodec,
+	interceptors []ServerInterceptor) {
+	handler := chainInterceptors(interceptors, func(call *Call) error {
+		c := call.codec
+		server.ServeRequest(c)
+		call.Reply = c.reply
+		if c.errMsg != "" {
+			return rpc.ServerError(c.errMsg)
+		}
+		return nil
+	})
+
+	var sending sync.Mutex
+	var wg sync.WaitGroup
+	for {
+		var req rpc.Request
+		err := codec.ReadRequestHeader(&req)
+		if err != nil {
+			break
+		}
+		call := &Call{Method: req.ServiceMethod, Start: time.Now()}
+		c := &singleCallCodec{call: call}
+		c.paramsErr = codec.ReadRequestBody(&c.params)
+		call.codec = c
+
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			reply := interface{}(invalidRequest)
+			resp := rpc.Response{ServiceMethod: call.Method, Seq: seq}
+			err := handler(call)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				reply = call.Reply
+			}
+			sending.Lock()
+			codec.WriteResponse(&resp, reply)
+			sending.Unlock()
+		}(req.Seq)
+	}
+	wg.Wait()
+	codec.Close()
+}
+
+// RecoverPanics returns interceptor that turns panics of rpc
+// handlers into errors sent to the caller. Panics are logged with
+// stack traces using logPrint, or at error level of package logging
+// if it's nil. It needs to
+// come after interceptors that run next handler in separate
+// goroutine.
+func RecoverPanics(logPrint func(args ...interface{})) ServerInterceptor {
+	if logPrint == nil {
+		logPrint = logging.PrintFunc(logging.LevelError)
+	}
+	return func(call *Call, next CallHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPrint(fmt.Sprintf("revrpc: panic in %s: %v\n%s",
+					call.Method, r, debug.Stack()))
+				err = fmt.Errorf("revrpc: %s failed: internal error",
+					call.Method)
+			}
+		}()
+		return next(call)
+	}
+}
+
+// LogSlowCalls returns interceptor that logs calls that took longer
+// than threshold using logPrint, or at warning level of package
+// logging if it's nil.
+func LogSlowCalls(threshold time.Duration,
+	logPrint func(args ...interface{})) ServerInterceptor {
+	if logPrint == nil {
+		logPrint = logging.PrintFunc(logging.LevelWarn)
+	}
+	return func(call *Call, next CallHandler) error {
+		err := next(call)
+		if d := time.Since(call.Start); d >= threshold {
+			logPrint(fmt.Sprintf("revrpc: slow call %s took %s "+
+				"(error: %v)", call.Method, d, err))
+		}
+		return err
+	}
+}
@@ -0,0 +1,235 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+// CodecHeader is header of RPCCONNECT request that lists codecs
+// service is willing to speak, most preferred first. ns_server
+// responds with the same header naming the chosen codec. Missing
+// response header means CodecJSONRPC1.
+const CodecHeader = "X-Revrpc-Codec"
+
+const (
+	// CodecJSONRPC1 is JSON-RPC 1.0 as implemented by
+	// net/rpc/jsonrpc. It's the default.
+	CodecJSONRPC1 = "jsonrpc-1.0"
+	// CodecJSONRPC2 is JSON-RPC 2.0. It carries structured errors
+	// (see Error) and allows results of any json type.
+	CodecJSONRPC2 = "jsonrpc-2.0"
+)
+
+// Error codes defined by JSON-RPC 2.0 spec.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeServerError is used for errors returned by rpc handlers
+	// that are not *Error.
+	CodeServerError = -32000
+)
+
+// Error is rpc error with JSON-RPC 2.0 code and data. rpc handlers
+// may return it to pass code and data to JSON-RPC 2.0 peers. JSON-RPC
+// 1.0 peers get just the message. Call returns *Error when the peer
+// sends JSON-RPC 2.0 error object.
+//
+// net/rpc passes only error strings from handlers to codecs, so
+// Error() encodes the whole error and it must be returned as is, not
+// wrapped.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+const errorPrefix = "revrpc-error:"
+
+func (e *Error) Error() string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf("%s%d: %s", errorPrefix, e.Code, e.Message)
+	}
+	return errorPrefix + string(b)
+}
+
+// parseError turns error string that net/rpc passes to codec back
+// into Error.
+func parseError(msg string) *Error {
+	if strings.HasPrefix(msg, errorPrefix) {
+		var e Error
+		if json.Unmarshal([]byte(msg[len(errorPrefix):]), &e) == nil {
+			return &e
+		}
+	}
+	code := CodeServerError
+	if strings.HasPrefix(msg, "rpc: can't find service ") ||
+		strings.HasPrefix(msg, "rpc: can't find method ") {
+		code = CodeMethodNotFound
+	}
+	return &Error{Code: code, Message: msg}
+}
+
+// errorMessage returns message of the error as JSON-RPC 1.0 peers
+// should see it.
+func errorMessage(msg string) string {
+	if strings.HasPrefix(msg, errorPrefix) {
+		return parseError(msg).Message
+	}
+	return msg
+}
+
+// errorFromPeer converts error member of response from the peer into
+// error returned by Call.
+func errorFromPeer(e interface{}) error {
+	if msg, ok := e.(string); ok {
+		return rpc.ServerError(msg)
+	}
+	b, _ := json.Marshal(e)
+	if obj, ok := e.(map[string]interface{}); ok {
+		_, hasCode := obj["code"]
+		_, hasMessage := obj["message"]
+		var rv Error
+		if hasCode && hasMessage && json.Unmarshal(b, &rv) == nil {
+			return &rv
+		}
+	}
+	return rpc.ServerError(string(b))
+}
+
+var errMissingVersion = errors.New("jsonrpc: missing or invalid version")
+
+type jsonrpc2Request struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+type jsonrpc2Response struct {
+	Version string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// jsonrpc2ServerCodec is JSON-RPC 2.0 counterpart of
+// net/rpc/jsonrpc server codec. Requests without id are
+// notifications and get no response.
+type jsonrpc2ServerCodec struct {
+	dec *json.Decoder
+	w   io.Writer
+	c   io.Closer
+
+	req jsonrpc2Request
+
+	l       sync.Mutex
+	seq     uint64
+	pending map[uint64]*json.RawMessage
+}
+
+func newJSONRPC2ServerCodec(conn io.ReadWriteCloser) *jsonrpc2ServerCodec {
+	return &jsonrpc2ServerCodec{
+		dec:     json.NewDecoder(conn),
+		w:       conn,
+		c:       conn,
+		pending: make(map[uint64]*json.RawMessage),
+	}
+}
+
+func (c *jsonrpc2ServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req = jsonrpc2Request{}
+	err := c.dec.Decode(&c.req)
+	if err != nil {
+		return err
+	}
+	r.ServiceMethod = c.req.Method
+
+	c.l.Lock()
+	c.seq++
+	c.pending[c.seq] = c.req.ID
+	r.Seq = c.seq
+	c.l.Unlock()
+	return nil
+}
+
+func (c *jsonrpc2ServerCodec) ReadRequestBody(x interface{}) error {
+	if c.req.Version != "2.0" {
+		return errMissingVersion
+	}
+	if x == nil || c.req.Params == nil {
+		return nil
+	}
+	params := *c.req.Params
+	if len(params) > 0 && params[0] == '[' {
+		// positional params: net/rpc methods take single argument
+		var args [1]interface{}
+		args[0] = x
+		return json.Unmarshal(params, &args)
+	}
+	return json.Unmarshal(params, x)
+}
+
+func (c *jsonrpc2ServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.l.Lock()
+	id, ok := c.pending[r.Seq]
+	if !ok {
+		c.l.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.l.Unlock()
+
+	if id == nil {
+		// notification
+		return nil
+	}
+
+	resp := jsonrpc2Response{Version: "2.0", ID: id}
+	if r.Error == "" {
+		result, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		raw := json.RawMessage(result)
+		resp.Result = &raw
+	} else {
+		resp.Error = parseError(r.Error)
+		if resp.Error.Message == errMissingVersion.Error() {
+			resp.Error.Code = CodeInvalidRequest
+		}
+	}
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(append(b, '\n'))
+	return err
+}
+
+func (c *jsonrpc2ServerCodec) Close() error {
+	return c.c.Close()
+}
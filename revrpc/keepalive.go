@@ -0,0 +1,100 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrIdleTimeout is returned from Run when nothing was received from
+// ns_server for longer than idle timeout (see SetIdleTimeout).
+var ErrIdleTimeout = errors.New("revrpc connection is idle for too long")
+
+// ErrHeartbeatTimeout is returned from Run when ns_server didn't
+// respond to heartbeat within heartbeat interval (see SetHeartbeat).
+var ErrHeartbeatTimeout = errors.New("revrpc heartbeat was not answered in time")
+
+// PingMethod is the method that is invoked on the other side of
+// revrpc connection to check that it's alive. Service itself also
+// handles PingMethod requests from ns_server.
+const PingMethod = "revrpc.Ping"
+
+// Ping does nothing. It allows ns_server to check that service is
+// alive and also keeps connection from becoming idle.
+func (s *RevrpcSvc) Ping(arg *struct{}, reply *bool) error {
+	*reply = true
+	return nil
+}
+
+// SetKeepAlive sets period of TCP keepalive probes of revrpc
+// connection. Zero means default period of net.Dialer and negative
+// value disables keepalives. Takes effect on the next (re)start of the
+// service.
+func (s *Service) SetKeepAlive(period time.Duration) {
+	s.l.Lock()
+	s.keepAlive = period
+	s.l.Unlock()
+}
+
+// SetIdleTimeout makes Run fail with ErrIdleTimeout if nothing is
+// received from ns_server for given duration. Zero disables idle
+// timeout, which is the default. As ns_server may legitimately stay
+// silent for long, it's only useful together with ns_server pinging
+// the service or with heartbeats (see SetHeartbeat). Takes effect on
+// the next (re)start of the service.
+func (s *Service) SetIdleTimeout(timeout time.Duration) {
+	s.l.Lock()
+	s.idleTimeout = timeout
+	s.l.Unlock()
+}
+
+// SetHeartbeat makes service call PingMethod of ns_server every
+// interval while connected. If no reply arrives within interval, the
+// connection is closed and Run fails with ErrHeartbeatTimeout. Error
+// reply counts as heartbeat too, since it proves that ns_server is
+// there. Zero disables heartbeats, which is the default. Takes effect
+// on the next (re)start of the service.
+func (s *Service) SetHeartbeat(interval time.Duration) {
+	s.l.Lock()
+	s.heartbeat = interval
+	s.l.Unlock()
+}
+
+func sendHeartbeats(mux *muxConn, rwc *minirwc, interval time.Duration,
+	done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := mux.call(ctx, PingMethod, nil, nil)
+		cancel()
+		switch err {
+		case context.DeadlineExceeded:
+			rwc.fail(ErrHeartbeatTimeout)
+			return
+		case ErrNotConnected:
+			return
+		}
+	}
+}
@@ -20,6 +20,7 @@ package revrpc
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,12 +32,13 @@ import (
 	"net/rpc/jsonrpc"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/couchbase/cbauth/logging"
 	"github.com/couchbase/cbauth/utils"
-	log "github.com/couchbase/clog"
 )
 
 // ServiceSetupCallback type defines functions that can be passed to
@@ -50,13 +52,30 @@ type serviceImpl interface {
 
 // Service type represents specific configured instance of revrpc.
 type Service struct {
-	l       sync.Mutex
-	running int32
-	user    string
-	pwd     string
-	url     *url.URL
-	codec   *jsonServerCodec
-	stopped bool
+	l            sync.Mutex
+	running      int32
+	endpoints    []endpoint
+	active       int
+	codec        *jsonServerCodec
+	mux          *muxConn
+	stopped      bool
+	drainTimeout time.Duration
+	interceptors []ServerInterceptor
+	keepAlive    time.Duration
+	idleTimeout  time.Duration
+	heartbeat    time.Duration
+	codecs       []string
+	// checkPeerCred, if set, verifies credentials of ns_server
+	// process on the other side of unix socket.
+	checkPeerCred func(PeerCred) error
+
+	state          State
+	stateStats     StateStats
+	connectedSince time.Time
+	subscribers    map[uint64]func(StateChange)
+	subscriberID   uint64
+	stateChanges   []StateChange
+	delivering     bool
 }
 
 type HttpError struct {
@@ -74,6 +93,15 @@ func (e *HttpError) Error() string {
 var ErrAlreadyRunning = errors.New("service is already running")
 var ErrRevRpcUnauthorized = errors.New("invalid revrpc credentials")
 
+// ErrDrainTimeout is returned from RunContext and
+// BabysitServiceContext if rpc handlers that were in flight when
+// context got done didn't finish within drain timeout.
+var ErrDrainTimeout = errors.New("timed out waiting for revrpc handlers to finish")
+
+// DefaultDrainTimeout is how long RunContext waits for in-flight rpc
+// handlers after context is done, unless changed by SetDrainTimeout.
+const DefaultDrainTimeout = 10 * time.Second
+
 const uaSvcSuffix = "service"
 const uaSvcVersion = ""
 
@@ -81,30 +109,74 @@ var userAgent = utils.MakeUserAgent(uaSvcSuffix, uaSvcVersion)
 
 // NewService creates and returns Service instance that connects to
 // given ns_server url (which is expected to have creds
-// encoded). Returns error if url is malformed. Does not actually
+// encoded). Besides http urls, ns_server may be reached via unix
+// socket (see SocketParam). Returns error if url is malformed. Does not actually
 // connect to ns_server, so it will succeed even if ns_server is not
 // running or if creds are not valid admin creds.
 func NewService(connectURL string) (*Service, error) {
-	u, err := url.Parse(connectURL)
-	if err != nil {
-		// TODO: nicer error maybe
-		return nil, err
+	return NewServiceWithEndpoints([]string{connectURL})
+}
+
+// NewServiceWithEndpoints is like NewService but accepts ordered list
+// of ns_server urls. Service starts with the first one and moves to
+// the next one every time it fails to connect, so that error policy
+// of BabysitService decides how fast endpoints are rotated. Once
+// connected, service sticks to the endpoint and retries it first
+// when connection is lost.
+func NewServiceWithEndpoints(connectURLs []string) (*Service, error) {
+	if len(connectURLs) == 0 {
+		return nil, errors.New("no revrpc endpoints given")
 	}
-	user := ""
-	pwd := ""
-	if ui := u.User; ui != nil {
-		user = ui.Username()
-		pwd, _ = ui.Password()
+	endpoints := make([]endpoint, len(connectURLs))
+	for i, connectURL := range connectURLs {
+		ep, err := parseEndpoint(connectURL)
+		if err != nil {
+			return nil, err
+		}
+		endpoints[i] = ep
 	}
 
 	return &Service{
-		user:    user,
-		pwd:     pwd,
-		url:     u,
-		stopped: false,
+		endpoints:    endpoints,
+		stopped:      false,
+		drainTimeout: DefaultDrainTimeout,
 	}, nil
 }
 
+// ActiveEndpoint returns url (without creds) of the endpoint service
+// is connected to or is going to connect to next.
+func (s *Service) ActiveEndpoint() *url.URL {
+	s.l.Lock()
+	defer s.l.Unlock()
+	u := *s.endpoints[s.active].url
+	u.User = nil
+	return &u
+}
+
+// Endpoints returns urls (without creds) of all endpoints of the
+// service in order.
+func (s *Service) Endpoints() []*url.URL {
+	s.l.Lock()
+	defer s.l.Unlock()
+	rv := make([]*url.URL, len(s.endpoints))
+	for i, ep := range s.endpoints {
+		u := *ep.url
+		u.User = nil
+		rv[i] = &u
+	}
+	return rv
+}
+
+// rotateEndpoint moves to the endpoint that follows endpoint i
+// unless some other endpoint was chosen meanwhile.
+func (s *Service) rotateEndpoint(i int) {
+	s.l.Lock()
+	if s.active == i {
+		s.active = (i + 1) % len(s.endpoints)
+	}
+	s.l.Unlock()
+}
+
 // MustService is like NewService except that it panics on
 // errors. I.e. it is useful in cases where errors are not expected.
 func MustService(connectURL string) *Service {
@@ -118,21 +190,80 @@ func MustService(connectURL string) *Service {
 type minirwc struct {
 	net.Conn
 	bufreader *bufio.Reader
+	// idleTimeout, if positive, fails reads when nothing arrives
+	// from the peer for that long.
+	idleTimeout time.Duration
+
+	l        sync.Mutex
+	draining bool
+	err      error
 }
 
 func (r *minirwc) Read(buf []byte) (n int, err error) {
-	return r.bufreader.Read(buf)
+	if r.idleTimeout > 0 {
+		r.l.Lock()
+		if !r.draining {
+			r.Conn.SetReadDeadline(time.Now().Add(r.idleTimeout))
+		}
+		r.l.Unlock()
+	}
+	n, err = r.bufreader.Read(buf)
+	if err != nil {
+		r.l.Lock()
+		if r.err != nil {
+			err = r.err
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+			r.idleTimeout > 0 && !r.draining {
+			r.err = ErrIdleTimeout
+			err = r.err
+		}
+		r.l.Unlock()
+	}
+	return
+}
+
+// stopReading makes pending and future reads fail immediately.
+func (r *minirwc) stopReading() {
+	r.l.Lock()
+	r.draining = true
+	r.Conn.SetReadDeadline(aLongTimeAgo)
+	r.l.Unlock()
+}
+
+// fail closes connection and makes err the reason of failure.
+func (r *minirwc) fail(err error) {
+	r.l.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.l.Unlock()
+	r.Conn.Close()
+}
+
+// failure returns reason of connection failure detected by us, if
+// any.
+func (r *minirwc) failure() error {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.err
 }
 
 type jsonServerCodec struct {
 	rpc.ServerCodec
+	jsonrpc2 bool
 }
 
-func newJsonServerCodec(conn io.ReadWriteCloser) *jsonServerCodec {
-	return &jsonServerCodec{jsonrpc.NewServerCodec(conn)}
+func newJsonServerCodec(conn io.ReadWriteCloser, codec string) *jsonServerCodec {
+	if codec == CodecJSONRPC2 {
+		return &jsonServerCodec{newJSONRPC2ServerCodec(conn), true}
+	}
+	return &jsonServerCodec{jsonrpc.NewServerCodec(conn), false}
 }
 
 func (c *jsonServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	if !c.jsonrpc2 {
+		r.Error = errorMessage(r.Error)
+	}
 	err := c.ServerCodec.WriteResponse(r, x)
 
 	// net/rpc drops any errors returned by WriteResponse on the floor:
@@ -182,12 +313,16 @@ type URLChangeResult struct {
 }
 
 func (s *RevrpcSvc) UpdateURL(urlChange URLChange, res *URLChangeResult) error {
-	rv := MustService(urlChange.NewURL)
-	req, _ := http.NewRequest("RPCCONNECT", rv.url.String()+"/test", nil)
-	req.SetBasicAuth(rv.user, rv.pwd)
+	ep := MustService(urlChange.NewURL).endpoints[0]
+	testURL := *ep.reqURL
+	testURL.Path += "/test"
+	req, _ := http.NewRequest("RPCCONNECT", testURL.String(), nil)
+	req.SetBasicAuth(ep.user, ep.pwd)
 	req.Header.Set("User-Agent", userAgent)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := ep.httpClient().Do(req)
 	if err != nil {
+		logging.Warn("revrpc: test RPCCONNECT failed", "url", ep.url,
+			"err", err)
 		*res = URLChangeResult{IsSucc: false, Description: err.Error()}
 		return nil
 	}
@@ -198,23 +333,78 @@ func (s *RevrpcSvc) UpdateURL(urlChange URLChange, res *URLChangeResult) error {
 		err = fmt.Errorf(
 			"test RPCCONNECT failed: need 200 status!. Got %v",
 			resp.StatusCode)
-		print(err)
+		logging.Warn("revrpc: test RPCCONNECT failed", "url", ep.url,
+			"err", err)
 		*res = URLChangeResult{IsSucc: false, Description: err.Error()}
 		return nil
 	}
 
-	s.service.url = rv.url
-	s.service.user = rv.user
-	s.service.pwd = rv.pwd
+	// ns_server updates url of the endpoint we're connected to
+	s.service.l.Lock()
+	s.service.endpoints[s.service.active] = ep
+	s.service.l.Unlock()
+	logging.Info("revrpc: url updated", "url", ep.url)
 	*res = URLChangeResult{IsSucc: true, Description: ""}
 	return nil
 }
 
+// SetCodecs sets codecs that service offers to ns_server during
+// RPCCONNECT, most preferred first (see CodecHeader). By default
+// nothing is offered and CodecJSONRPC1 is used. Takes effect on the
+// next (re)start of the service.
+func (s *Service) SetCodecs(codecs ...string) {
+	s.l.Lock()
+	s.codecs = append([]string{}, codecs...)
+	s.l.Unlock()
+}
+
+// SetDrainTimeout sets how long RunContext waits for in-flight rpc
+// handlers to finish after its context is done.
+func (s *Service) SetDrainTimeout(timeout time.Duration) {
+	s.l.Lock()
+	s.drainTimeout = timeout
+	s.l.Unlock()
+}
+
+// watchContext calls fn if ctx gets done before returned stop
+// function is called. stop returns false if fn was called.
+func watchContext(ctx context.Context, fn func()) (stop func() bool) {
+	stopCh := make(chan struct{})
+	res := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			fn()
+			res <- false
+		case <-stopCh:
+			res <- true
+		}
+	}()
+	return func() bool {
+		close(stopCh)
+		return <-res
+	}
+}
+
+// aLongTimeAgo is a deadline that makes pending and future IO on a
+// connection fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
 // Run method connects to ns_server, sets up json rpc instance and
 // handles rpc requests loop until connection is alive. Returned error
 // is always non-nil. In case connection was closed by ns_server
 // io.EOF is returned.
 func (s *Service) Run(setupBody ServiceSetupCallback) error {
+	return s.RunContext(context.Background(), setupBody)
+}
+
+// RunContext is like Run but also stops when given context is
+// done. Connecting to ns_server is aborted at any stage. Once
+// connected, Service stops reading new requests and waits for rpc
+// handlers that are in flight to send their replies, but at most
+// drain timeout (see SetDrainTimeout). ctx.Err() is returned if
+// handlers were drained and ErrDrainTimeout otherwise.
+func (s *Service) RunContext(ctx context.Context, setupBody ServiceSetupCallback) (err error) {
 	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
 		return ErrAlreadyRunning
 	}
@@ -227,43 +417,65 @@ func (s *Service) Run(setupBody ServiceSetupCallback) error {
 		s.l.Unlock()
 		return io.EOF
 	}
-	s.l.Unlock()
+	active := s.active
+	ep := s.endpoints[active]
+	drainTimeout := s.drainTimeout
+	interceptors := s.interceptors
+	keepAlive, idleTimeout := s.keepAlive, s.idleTimeout
+	heartbeat := s.heartbeat
+	codecs := s.codecs
+	checkPeerCred := s.checkPeerCred
+	s.setStateLocked(StateConnecting, nil)
+	s.deliverStateChangesAndUnlock()
+
+	handshaked := false
+	defer func() {
+		switch {
+		case handshaked:
+			logging.Info("revrpc: disconnected", "url", ep.url,
+				"err", err)
+		case ctx.Err() == nil:
+			// the error is logged by error policy of
+			// BabysitService
+			s.rotateEndpoint(active)
+		}
+		s.setState(StateDisconnected, err)
+	}()
 
-	conn, err := net.Dial("tcp", s.url.Host)
+	dialer := net.Dialer{KeepAlive: keepAlive}
+	conn, err := dialer.DialContext(ctx, ep.network, ep.address)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 	defer conn.Close()
 
-	conn.(*net.TCPConn).SetNoDelay(true)
+	if checkPeerCred != nil {
+		err = verifyPeerCred(conn, checkPeerCred)
+		if err != nil {
+			return err
+		}
+	}
 
-	req, _ := http.NewRequest("RPCCONNECT", s.url.String(), nil)
-	req.SetBasicAuth(s.user, s.pwd)
-	req.Header.Set("User-Agent", userAgent)
-	err = req.Write(conn)
-	if err != nil {
-		return err
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+
+	stopWatch := watchContext(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	connr, codecName, err := s.handshake(conn, ep, codecs)
+	if !stopWatch() {
+		return ctx.Err()
 	}
-	connr := bufio.NewReader(conn)
-	rwc := &minirwc{Conn: conn, bufreader: connr}
-	resp, err := http.ReadResponse(connr, req)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		if resp.StatusCode == 401 {
-			return ErrRevRpcUnauthorized
-		}
-		var message = ""
-		if resp.StatusCode == 400 {
-			body, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				message = string(body)
-			}
-			resp.Body.Close()
-		}
-		return &HttpError{StatusCode: resp.StatusCode, Message: message}
-	}
+	handshaked = true
+	logging.Info("revrpc: connected", "url", ep.url, "codec", codecName)
+	rwc := &minirwc{Conn: conn, bufreader: connr, idleTimeout: idleTimeout}
 
 	rpcServer := rpc.NewServer()
 	err = setupBody(rpcServer)
@@ -272,7 +484,8 @@ func (s *Service) Run(setupBody ServiceSetupCallback) error {
 		return err
 	}
 
-	codec := newJsonServerCodec(rwc)
+	mux := newMuxConn(rwc, codecName == CodecJSONRPC2)
+	codec := newJsonServerCodec(mux, codecName)
 
 	s.l.Lock()
 	if s.stopped {
@@ -281,26 +494,115 @@ func (s *Service) Run(setupBody ServiceSetupCallback) error {
 		return io.EOF
 	}
 	s.codec = codec
-	s.l.Unlock()
+	s.mux = mux
+	s.setStateLocked(StateConnected, nil)
+	s.deliverStateChangesAndUnlock()
 
-	rpcServer.ServeCodec(codec)
+	defer func() {
+		s.l.Lock()
+		if s.codec == codec {
+			s.codec = nil
+			s.mux = nil
+		}
+		s.l.Unlock()
+	}()
 
-	return io.EOF
+	served := make(chan struct{})
+	go func() {
+		if len(interceptors) == 0 {
+			rpcServer.ServeCodec(codec)
+		} else {
+			serveCodecIntercepted(rpcServer, codec, interceptors)
+		}
+		close(served)
+	}()
+
+	if heartbeat > 0 {
+		go sendHeartbeats(mux, rwc, heartbeat, served)
+	}
+
+	select {
+	case <-served:
+		if err := rwc.failure(); err != nil {
+			return err
+		}
+		return io.EOF
+	case <-ctx.Done():
+	}
+
+	// ServeCodec stops reading requests on the first read error and
+	// then waits for in-flight handlers to reply before returning
+	rwc.stopReading()
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-served:
+		return ctx.Err()
+	case <-timer.C:
+		codec.Close()
+		return ErrDrainTimeout
+	}
 }
 
-func (s *Service) Disconnect() error {
-	s.l.Lock()
-	defer s.l.Unlock()
-	if s.codec == nil {
-		s.stopped = true
-		return nil
+func (s *Service) handshake(conn net.Conn, ep endpoint,
+	codecs []string) (*bufio.Reader, string, error) {
+	req, _ := http.NewRequest("RPCCONNECT", ep.reqURL.String(), nil)
+	req.SetBasicAuth(ep.user, ep.pwd)
+	req.Header.Set("User-Agent", userAgent)
+	if len(codecs) != 0 {
+		req.Header.Set(CodecHeader, strings.Join(codecs, ", "))
 	}
-	err := s.codec.Close()
+	err := req.Write(conn)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	connr := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(connr, req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != 200 {
+		if resp.StatusCode == 401 {
+			return nil, "", ErrRevRpcUnauthorized
+		}
+		var message = ""
+		if resp.StatusCode == 400 {
+			body, err := ioutil.ReadAll(resp.Body)
+			if err == nil {
+				message = string(body)
+			}
+			resp.Body.Close()
+		}
+		return nil, "", &HttpError{StatusCode: resp.StatusCode, Message: message}
+	}
+
+	codec := resp.Header.Get(CodecHeader)
+	if codec == "" {
+		return connr, CodecJSONRPC1, nil
+	}
+	for _, c := range codecs {
+		if c == codec {
+			return connr, codec, nil
+		}
+	}
+	return nil, "", fmt.Errorf("ns_server chose codec %q that was not offered",
+		codec)
+}
+
+func (s *Service) Disconnect() error {
+	s.l.Lock()
+	if s.codec != nil {
+		err := s.codec.Close()
+		if err != nil {
+			s.l.Unlock()
+			return err
+		}
+		s.codec = nil
+		s.mux = nil
 	}
-	s.codec = nil
 	s.stopped = true
+	s.setStateLocked(StateStopped, nil)
+	s.deliverStateChangesAndUnlock()
 	return nil
 }
 
@@ -319,6 +621,26 @@ type BabysitErrorPolicy interface {
 	New() ErrorPolicyFn
 }
 
+// ServiceErrorPolicy is BabysitErrorPolicy that can be bound to
+// context and service of BabysitServiceContext invocation, which then
+// uses NewForService instead of New. ErrorPolicyFn returned by
+// NewForService must stop sleeping between restarts and return
+// ctx.Err() once ctx is done.
+type ServiceErrorPolicy interface {
+	BabysitErrorPolicy
+	NewForService(ctx context.Context, svc *Service) ErrorPolicyFn
+}
+
+// NewErrorPolicyFn returns ErrorPolicyFn of given policy bound to ctx
+// and svc if policy supports that.
+func NewErrorPolicyFn(policy BabysitErrorPolicy, ctx context.Context,
+	svc *Service) ErrorPolicyFn {
+	if sp, ok := policy.(ServiceErrorPolicy); ok {
+		return sp.NewForService(ctx, svc)
+	}
+	return policy.New()
+}
+
 // DefaultErrorPolicy is default configurable implementation of
 // BabysitErrorPolicy.
 type DefaultErrorPolicy struct {
@@ -331,9 +653,10 @@ type DefaultErrorPolicy struct {
 	SleepBetweenRestarts time.Duration
 	// LogPrint function, if non-nil, is used by
 	// DefaultErrorPolicy to log it's events & decisions.
-	// log.Print function is one suitable implementation.
+	// logging.PrintFunc returns suitable implementations.
 	LogPrint     func(args ...interface{})
 	restartsLeft int
+	ctx          context.Context
 }
 
 // DefaultBabysitErrorPolicy is BabysitErrorPolicy instance that is
@@ -342,7 +665,7 @@ type DefaultErrorPolicy struct {
 var DefaultBabysitErrorPolicy BabysitErrorPolicy = DefaultErrorPolicy{
 	RestartsToExit:       -1,
 	SleepBetweenRestarts: time.Second,
-	LogPrint:             log.Print,
+	LogPrint:             logging.PrintFunc(logging.LevelWarn),
 }
 
 func (p *DefaultErrorPolicy) try(err error) error {
@@ -361,9 +684,7 @@ func (p *DefaultErrorPolicy) try(err error) error {
 	}
 
 	p.LogPrint(fmt.Sprintf("revrpc: Got error (%s) and will retry in %s", err, p.SleepBetweenRestarts))
-	time.Sleep(p.SleepBetweenRestarts)
-
-	return nil
+	return utils.Sleep(p.ctx, utils.RealClock{}, p.SleepBetweenRestarts)
 }
 
 // New method of DefaultErrorPolicy implements New method of
@@ -371,8 +692,156 @@ func (p *DefaultErrorPolicy) try(err error) error {
 // allow configured number of restarts and will sleep configured
 // duration between restarts.
 func (p DefaultErrorPolicy) New() ErrorPolicyFn {
+	return p.NewForService(context.Background(), nil)
+}
+
+// NewForService method of DefaultErrorPolicy implements
+// ServiceErrorPolicy interface.
+func (p DefaultErrorPolicy) NewForService(ctx context.Context,
+	svc *Service) ErrorPolicyFn {
 	// NOTE: that p is _copy_ of policy instance
 	p.restartsLeft = p.RestartsToExit
+	p.ctx = ctx
+	return (&p).try
+}
+
+// IsVersionNotSupported returns true if given error means that
+// ns_server doesn't support revrpc protocol version requested by the
+// service.
+func IsVersionNotSupported(err error) bool {
+	httpErr, ok := err.(*HttpError)
+	return ok && httpErr.StatusCode == 400 &&
+		httpErr.Message == "Version is not supported"
+}
+
+// IsFatalError returns true for errors that restarting the service
+// cannot fix, i.e. invalid credentials or unsupported protocol
+// version.
+func IsFatalError(err error) bool {
+	return err == ErrRevRpcUnauthorized || IsVersionNotSupported(err)
+}
+
+// Clock is source of time for BackoffErrorPolicy. It exists so that
+// the policy can be tested without actually sleeping.
+type Clock = utils.Clock
+
+// BackoffErrorPolicy is BabysitErrorPolicy that sleeps between
+// restarts for random duration ("full jitter") of up to exponentially
+// growing backoff (see utils.Backoff). This way services that lost
+// connection at the same time don't reconnect in lockstep. Backoff is
+// reset once service stays connected for HealthyPeriod, which is only
+// known to policy bound to the service by BabysitServiceContext. Zero
+// fields take default values.
+type BackoffErrorPolicy struct {
+	// InitialBackoff is the backoff before the first restart.
+	// Default is 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff. Default is 30s.
+	MaxBackoff time.Duration
+	// HealthyPeriod is how long service needs to stay connected
+	// for backoff to be reset. Default is 1m.
+	HealthyPeriod time.Duration
+	// RestartsToExit determines how many consecutive restarts
+	// this error policy will do before giving up. Zero or negative
+	// value means restart infinitely.
+	RestartsToExit int
+	// IsFatal classifies errors that must not cause restarts.
+	// Default is IsFatalError.
+	IsFatal func(err error) bool
+	// LogPrint function, if non-nil, is used to log policy
+	// decisions.
+	LogPrint func(args ...interface{})
+	// Clock, if non-nil, replaces real time.
+	Clock Clock
+	// Int63n, if non-nil, replaces rand.Int63n as source of jitter.
+	Int63n func(n int64) int64
+
+	backoff utils.Backoff
+	ctx     context.Context
+	svc     *Service
+	stats   StateStats
+}
+
+// BackoffBabysitErrorPolicy is BackoffErrorPolicy instance with
+// default settings that logs via package logging.
+var BackoffBabysitErrorPolicy BabysitErrorPolicy = BackoffErrorPolicy{
+	LogPrint: logging.PrintFunc(logging.LevelWarn),
+}
+
+func (p *BackoffErrorPolicy) log(args ...interface{}) {
+	if p.LogPrint != nil {
+		p.LogPrint(args...)
+	}
+}
+
+func (p *BackoffErrorPolicy) try(err error) error {
+	if p.IsFatal(err) {
+		p.log("revrpc: Will not retry on fatal error: ", err)
+		return err
+	}
+
+	if p.svc != nil {
+		// time spent dialing doesn't count, only time connected
+		stats := p.svc.Stats()
+		if stats.Connects > p.stats.Connects &&
+			stats.TimeConnected-p.stats.TimeConnected >= p.HealthyPeriod {
+			p.backoff.Reset()
+		}
+		p.stats = stats
+	}
+	if p.RestartsToExit > 0 && p.backoff.Attempts() >= p.RestartsToExit {
+		if err == nil {
+			err = errors.New("Retries exceeded")
+		}
+		p.log("revrpc: Will not retry on error: ", err)
+		return err
+	}
+
+	sleep := p.backoff.Next()
+	p.log(fmt.Sprintf("revrpc: Got error (%s) and will retry in %s",
+		err, sleep))
+	return utils.Sleep(p.ctx, p.Clock, sleep)
+}
+
+// New method of BackoffErrorPolicy implements New method of
+// BabysitErrorPolicy interface.
+func (p BackoffErrorPolicy) New() ErrorPolicyFn {
+	return p.NewForService(context.Background(), nil)
+}
+
+// NewForService method of BackoffErrorPolicy implements
+// ServiceErrorPolicy interface.
+func (p BackoffErrorPolicy) NewForService(ctx context.Context,
+	svc *Service) ErrorPolicyFn {
+	// NOTE: that p is _copy_ of policy instance
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.HealthyPeriod <= 0 {
+		p.HealthyPeriod = time.Minute
+	}
+	if p.IsFatal == nil {
+		p.IsFatal = IsFatalError
+	}
+	if p.Clock == nil {
+		p.Clock = utils.RealClock{}
+	}
+	p.backoff = utils.Backoff{
+		Initial: p.InitialBackoff,
+		Max:     p.MaxBackoff,
+		Int63n:  p.Int63n,
+	}
+	p.ctx = ctx
+	p.svc = svc
+	if svc != nil {
+		p.stats = svc.Stats()
+	}
 	return (&p).try
 }
 
@@ -393,20 +862,98 @@ var NoRestartsBabysitErrorPolicy BabysitErrorPolicy = FnBabysitErrorPolicy(func(
 // can be passed to errorPolicy argument, in which case value of
 // DefaultBabysitErrorPolicy is used.
 func BabysitService(setupBody ServiceSetupCallback, svc *Service, errorPolicy BabysitErrorPolicy) error {
+	return BabysitServiceContext(context.Background(), setupBody, svc,
+		errorPolicy)
+}
+
+// BabysitServiceContext is like BabysitService but also stops once
+// given context is done (see RunContext). In that case ctx.Err() is
+// returned, or ErrDrainTimeout if in-flight rpc handlers didn't finish
+// in time. If service is stopped by Disconnect, io.EOF is
+// returned. Otherwise, error returned by error policy is returned.
+// Policies implementing ServiceErrorPolicy are bound to ctx, so that
+// sleeps between restarts don't delay return.
+func BabysitServiceContext(ctx context.Context, setupBody ServiceSetupCallback,
+	svc *Service, errorPolicy BabysitErrorPolicy) error {
 	if errorPolicy == nil {
 		errorPolicy = DefaultBabysitErrorPolicy
 	}
-	errorFn := errorPolicy.New()
+	errorFn := NewErrorPolicyFn(errorPolicy, ctx, svc)
 	for {
-		err := errorFn(svc.Run(setupBody))
+		err := svc.RunContext(ctx, setupBody)
+		if ctx.Err() != nil {
+			if err == ErrDrainTimeout {
+				return err
+			}
+			return ctx.Err()
+		}
+		if svc.State() == StateStopped {
+			// there's no point restarting service after Disconnect
+			return err
+		}
+		err = errorFn(err)
 		if err != nil {
 			return err
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
 }
 
-func doGetServiceFromEnv(serviceName string) (*Service, error) {
-	rurl := os.Getenv("CBAUTH_REVRPC_URL")
+// ServiceOptions configures Service created by NewServiceFromEnv. Zero
+// values mean defaults.
+type ServiceOptions struct {
+	// Getenv looks up environment variables. Default is os.Getenv.
+	Getenv func(key string) string
+	// DrainTimeout is passed to SetDrainTimeout.
+	DrainTimeout time.Duration
+	// KeepAlive is passed to SetKeepAlive.
+	KeepAlive time.Duration
+	// IdleTimeout is passed to SetIdleTimeout.
+	IdleTimeout time.Duration
+	// Heartbeat is passed to SetHeartbeat.
+	Heartbeat time.Duration
+	// Codecs are passed to SetCodecs.
+	Codecs []string
+	// Interceptors are passed to SetInterceptors.
+	Interceptors []ServerInterceptor
+	// PeerCredCheck is passed to SetPeerCredCheck.
+	PeerCredCheck func(PeerCred) error
+}
+
+// NewServiceFromEnv returns new Service instance that connects to
+// ns_server according to CBAUTH_REVRPC_URL environment variable.
+// Unlike GetDefaultServiceFromEnv it can be called any number of
+// times, so it's up to the caller to make sure that services don't
+// compete for the same name. opts may be nil.
+func NewServiceFromEnv(serviceName string, opts *ServiceOptions) (*Service, error) {
+	if opts == nil {
+		opts = &ServiceOptions{}
+	}
+	getenv := opts.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	svc, err := doGetServiceFromEnv(serviceName, getenv)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DrainTimeout != 0 {
+		svc.SetDrainTimeout(opts.DrainTimeout)
+	}
+	svc.SetKeepAlive(opts.KeepAlive)
+	svc.SetIdleTimeout(opts.IdleTimeout)
+	svc.SetHeartbeat(opts.Heartbeat)
+	svc.SetCodecs(opts.Codecs...)
+	svc.SetInterceptors(opts.Interceptors...)
+	svc.SetPeerCredCheck(opts.PeerCredCheck)
+	return svc, nil
+}
+
+func doGetServiceFromEnv(serviceName string,
+	getenv func(string) string) (*Service, error) {
+	rurl := getenv("CBAUTH_REVRPC_URL")
 	if rurl == "" {
 		return nil, fmt.Errorf("cbauth environment variable " +
 			"CBAUTH_REVRPC_URL is not set")
@@ -419,7 +966,7 @@ func doGetServiceFromEnv(serviceName string) (*Service, error) {
 			"Parsing it failed with: %s", err)
 	}
 
-	u.Path = u.Path + "-" + serviceName
+	appendToRequestPath(u, "-"+serviceName)
 	surl := u.String()
 
 	// parsing url cannot fail due to way it was constructed.
@@ -432,16 +979,25 @@ var defaultsGotL sync.Mutex
 // GetDefaultServiceFromEnv returns Service instance that connects to
 // ns_server according to CBAUTH_REVRPC_URL environment variable. Trying to
 // obtain same service twice will return error. I.e. you're supposed to get
-// your Service instance once and only once and hold it forever.
+// your Service instance once and only once and hold it forever. See
+// NewServiceFromEnv for non-singleton alternative.
 func GetDefaultServiceFromEnv(serviceName string) (*Service, error) {
 	defaultsGotL.Lock()
 	defer defaultsGotL.Unlock()
 	if defaultsGot[serviceName] {
 		return nil, fmt.Errorf("Service `%s' was already obtained (and presumably started)", serviceName)
 	}
-	svc, err := doGetServiceFromEnv(serviceName)
+	svc, err := NewServiceFromEnv(serviceName, nil)
 	if err == nil {
 		defaultsGot[serviceName] = true
 	}
 	return svc, err
 }
+
+// ResetDefaultServicesForTest makes GetDefaultServiceFromEnv forget
+// services that were already obtained. It's meant for tests only.
+func ResetDefaultServicesForTest() {
+	defaultsGotL.Lock()
+	defaultsGot = make(map[string]bool)
+	defaultsGotL.Unlock()
+}
@@ -0,0 +1,174 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"time"
+)
+
+// State is state of revrpc connection of Service.
+type State int
+
+const (
+	// StateDisconnected means that service is not connected to
+	// ns_server. It's the initial state.
+	StateDisconnected State = iota
+	// StateConnecting means that service is establishing connection
+	// to ns_server.
+	StateConnecting
+	// StateConnected means that service is connected to ns_server
+	// and serves its requests.
+	StateConnected
+	// StateStopped means that service was stopped by Disconnect and
+	// will not connect anymore.
+	StateStopped
+)
+
+func (st State) String() string {
+	switch st {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// StateStats are counters of connection state changes of Service.
+type StateStats struct {
+	// Connects is how many times connection was established.
+	Connects uint64
+	// Failures is how many connection attempts failed.
+	Failures uint64
+	// TimeConnected is total time spent connected.
+	TimeConnected time.Duration
+}
+
+// StateChange describes transition of Service from one state to
+// another.
+type StateChange struct {
+	From State
+	To   State
+	Time time.Time
+	// Err is error that caused the transition, if any.
+	Err   error
+	Stats StateStats
+}
+
+// State returns current connection state of the service.
+func (s *Service) State() State {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.state
+}
+
+// Stats returns connection state counters of the service.
+func (s *Service) Stats() StateStats {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.statsLocked(time.Now())
+}
+
+func (s *Service) statsLocked(now time.Time) StateStats {
+	rv := s.stateStats
+	if s.state == StateConnected {
+		rv.TimeConnected += now.Sub(s.connectedSince)
+	}
+	return rv
+}
+
+// Subscribe registers function that is called on every state change
+// of the service. Changes are delivered one at a time in the order
+// they happened. The function is allowed to call methods of Service.
+// Returned function unsubscribes.
+func (s *Service) Subscribe(fn func(StateChange)) (unsubscribe func()) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[uint64]func(StateChange))
+	}
+	s.subscriberID++
+	id := s.subscriberID
+	s.subscribers[id] = fn
+	return func() {
+		s.l.Lock()
+		delete(s.subscribers, id)
+		s.l.Unlock()
+	}
+}
+
+func (s *Service) setState(to State, err error) {
+	s.l.Lock()
+	s.setStateLocked(to, err)
+	s.deliverStateChangesAndUnlock()
+}
+
+func (s *Service) setStateLocked(to State, err error) {
+	from := s.state
+	if from == to || from == StateStopped {
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case to == StateConnected:
+		s.stateStats.Connects++
+		s.connectedSince = now
+	case from == StateConnected:
+		s.stateStats.TimeConnected += now.Sub(s.connectedSince)
+	case from == StateConnecting && err != nil:
+		s.stateStats.Failures++
+	}
+	s.state = to
+
+	s.stateChanges = append(s.stateChanges, StateChange{
+		From:  from,
+		To:    to,
+		Time:  now,
+		Err:   err,
+		Stats: s.stateStats,
+	})
+}
+
+// deliverStateChangesAndUnlock delivers queued state changes to
+// subscribers unless some other goroutine is already doing that.
+// Must be called with s.l held, which it releases.
+func (s *Service) deliverStateChangesAndUnlock() {
+	if s.delivering {
+		s.l.Unlock()
+		return
+	}
+	s.delivering = true
+	for len(s.stateChanges) > 0 {
+		change := s.stateChanges[0]
+		s.stateChanges = s.stateChanges[1:]
+		subscribers := make([]func(StateChange), 0, len(s.subscribers))
+		for _, fn := range s.subscribers {
+			subscribers = append(subscribers, fn)
+		}
+		s.l.Unlock()
+		for _, fn := range subscribers {
+			fn(change)
+		}
+		s.l.Lock()
+	}
+	s.delivering = false
+	s.l.Unlock()
+}
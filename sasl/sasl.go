@@ -0,0 +1,214 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sasl implements server side of SASL authentication on top of
+// credentials data that ns_server delivers to cbauth. It is meant for
+// services that speak binary protocols and need to authenticate
+// clients without handling plain text passwords.
+//
+// SCRAM-SHA mechanisms are verified against SCRAM data of the user
+// returned by ns_server. PLAIN is verified the same way Auth call of
+// cbauth.Authenticator does it, and is disabled unless allowed
+// explicitly.
+//
+// Usage is the following:
+//
+//	srv, err := sasl.NewServer(nil)
+//	...
+//	sess, err := srv.Start(mech)
+//	for {
+//		out, done, err := sess.Step(in)
+//		// send out or err to the client
+//		if done || err != nil {
+//			break
+//		}
+//		// read next in from the client
+//	}
+//	creds := sess.Creds()
+package sasl
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// ErrUnsupportedMech is returned by Start for mechanisms that are
+// not supported or not allowed.
+var ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
+
+// ErrAuthFailed is returned by Step if client didn't prove knowledge
+// of the password or the user is unknown.
+var ErrAuthFailed = errors.New("SASL authentication failed")
+
+// ErrBadMessage is returned by Step if client message doesn't conform
+// to the mechanism.
+var ErrBadMessage = errors.New("Malformed SASL message")
+
+// ErrSessionDone is returned by Step if the session is already
+// completed.
+var ErrSessionDone = errors.New("SASL session is already completed")
+
+// Backend is source of credentials data for Server. Authenticator
+// implemented by cbauth satisfies it.
+type Backend interface {
+	// Auth verifies given user and password.
+	Auth(user, pwd string) (cbauth.Creds, error)
+	// GetUserAuthInfo returns SCRAM-SHA data of given user together
+	// with Creds representing the user. Returns
+	// cbauth.ErrUserNotFound for unknown users.
+	GetUserAuthInfo(user string) (*cbauthimpl.UserAuthInfo, cbauth.Creds, error)
+}
+
+// Server creates authentication sessions. It is safe for concurrent
+// use.
+type Server struct {
+	// AllowPlain permits PLAIN mechanism. Note that PLAIN sends
+	// password in clear text unless connection is encrypted.
+	AllowPlain bool
+
+	b Backend
+	// secret is used to derive salts for unknown users, so that
+	// clients can't tell unknown user from a wrong password.
+	secret []byte
+}
+
+// NewServer returns Server that uses given authenticator as Backend.
+// If given authenticator is nil, Default authenticator is used. Returns
+// cbauth.ErrUnsupportedAuthenticator if the authenticator is not the
+// one implemented by cbauth.
+func NewServer(a cbauth.Authenticator) (*Server, error) {
+	var rv *Server
+	err := cbauth.WithAuthenticator(a, func(a cbauth.Authenticator) error {
+		b, ok := a.(Backend)
+		if !ok {
+			return cbauth.ErrUnsupportedAuthenticator
+		}
+		rv = NewServerWithBackend(b)
+		return nil
+	})
+	return rv, err
+}
+
+// NewServerWithBackend returns Server that uses given Backend.
+func NewServerWithBackend(b Backend) *Server {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic("Unable to generate secret: " + err.Error())
+	}
+	return &Server{b: b, secret: secret}
+}
+
+// Mechanisms returns mechanisms supported by the server in order of
+// preference. Result is suitable for SASL_LIST_MECHS kind of replies
+// after joining with spaces.
+func (s *Server) Mechanisms() []string {
+	rv := make([]string, 0, len(scramMechs)+1)
+	for _, m := range scramMechs {
+		rv = append(rv, m.name)
+	}
+	if s.AllowPlain {
+		rv = append(rv, "PLAIN")
+	}
+	return rv
+}
+
+// Start begins authentication session for given mechanism.
+func (s *Server) Start(mech string) (*Session, error) {
+	if mech == "PLAIN" && s.AllowPlain {
+		sess := &Session{mech: mech}
+		sess.step = func(in []byte) ([]byte, bool, error) {
+			return s.stepPlain(sess, in)
+		}
+		return sess, nil
+	}
+	for i := range scramMechs {
+		if scramMechs[i].name == mech {
+			return s.startScram(&scramMechs[i]), nil
+		}
+	}
+	return nil, ErrUnsupportedMech
+}
+
+// Session is authentication session of one client. Step is supposed
+// to be called with every client message until it reports that
+// session is done or returns an error. Session is not safe for
+// concurrent use.
+type Session struct {
+	mech  string
+	step  func(in []byte) ([]byte, bool, error)
+	done  bool
+	err   error
+	creds cbauth.Creds
+}
+
+// Mechanism returns mechanism of the session.
+func (sess *Session) Mechanism() string {
+	return sess.mech
+}
+
+// Step consumes client message and returns server message that is to
+// be sent to the client. done is true when authentication has
+// completed successfully, in which case out (if not empty) must still
+// be delivered to the client. Once error is returned the session is
+// failed and all further calls return the same error.
+func (sess *Session) Step(in []byte) (out []byte, done bool, err error) {
+	if sess.err != nil {
+		return nil, false, sess.err
+	}
+	if sess.done {
+		return nil, false, ErrSessionDone
+	}
+	out, done, err = sess.step(in)
+	if err != nil {
+		sess.err = err
+		return nil, false, err
+	}
+	sess.done = done
+	return out, done, nil
+}
+
+// Creds returns creds of authenticated user. Returns nil until the
+// session is successfully completed.
+func (sess *Session) Creds() cbauth.Creds {
+	if !sess.done {
+		return nil
+	}
+	return sess.creds
+}
+
+func (s *Server) stepPlain(sess *Session, in []byte) ([]byte, bool, error) {
+	parts := strings.Split(string(in), "\x00")
+	if len(parts) != 3 || parts[1] == "" {
+		return nil, false, ErrBadMessage
+	}
+	authzid, user, pwd := parts[0], parts[1], parts[2]
+	if authzid != "" && authzid != user {
+		return nil, false, ErrAuthFailed
+	}
+	creds, err := s.b.Auth(user, pwd)
+	if err == cbauth.ErrNoAuth {
+		return nil, false, ErrAuthFailed
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	sess.creds = creds
+	return nil, true, nil
+}
@@ -0,0 +1,216 @@
+package sasl
+
+import (
+	"testing"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/cbauthimpl"
+	"github.com/couchbase/goutils/scramsha"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type testCreds string
+
+func (c testCreds) Name() string                        { return string(c) }
+func (c testCreds) Domain() string                      { return "local" }
+func (c testCreds) User() (string, string)              { return string(c), "local" }
+func (c testCreds) IsAllowed(perm string) (bool, error) { return false, nil }
+
+type testBackend map[string]string
+
+func (b testBackend) Auth(user, pwd string) (cbauth.Creds, error) {
+	if p, ok := b[user]; ok && p == pwd {
+		return testCreds(user), nil
+	}
+	return nil, cbauth.ErrNoAuth
+}
+
+func scramInfo(mech *scramMech, pwd string) *cbauthimpl.ScramInfo {
+	h := mech.hash
+	salt := []byte("0123456789abcdef")
+	salted := pbkdf2.Key([]byte(pwd), salt, 100, h().Size(), h)
+	storedKey := h()
+	storedKey.Write(hmacSum(h, salted, []byte("Client Key")))
+	return &cbauthimpl.ScramInfo{
+		Salt:       salt,
+		Iterations: 100,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  hmacSum(h, salted, []byte("Server Key")),
+	}
+}
+
+func (b testBackend) GetUserAuthInfo(user string) (*cbauthimpl.UserAuthInfo, cbauth.Creds, error) {
+	pwd, ok := b[user]
+	if !ok {
+		return nil, nil, cbauth.ErrUserNotFound
+	}
+	return &cbauthimpl.UserAuthInfo{
+		User:        user,
+		Domain:      "local",
+		ScramSha512: scramInfo(&scramMechs[0], pwd),
+		ScramSha256: scramInfo(&scramMechs[1], pwd),
+		ScramSha1:   scramInfo(&scramMechs[2], pwd),
+	}, testCreds(user), nil
+}
+
+func newTestServer() *Server {
+	return NewServerWithBackend(testBackend{"alice": "secret", "a,b": "pwd"})
+}
+
+func scramAuth(t *testing.T, srv *Server, mech, user, pwd string) (cbauth.Creds, error) {
+	client, err := scramsha.NewScramSha(mech)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := srv.Start(mech)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := client.GetStartRequest(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, done, err := sess.Step([]byte(first))
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		t.Fatalf("Session must not complete after first message")
+	}
+	err = client.HandleStartResponse(string(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, done, err = sess.Step([]byte(client.GetFinalRequest(pwd)))
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		t.Fatalf("Expected session to complete")
+	}
+	err = client.HandleFinalResponse(string(out))
+	if err != nil {
+		t.Fatalf("Client failed to verify server signature: %v", err)
+	}
+
+	_, _, err = sess.Step(nil)
+	if err != ErrSessionDone {
+		t.Fatalf("Expected ErrSessionDone. Got %v", err)
+	}
+	return sess.Creds(), nil
+}
+
+func TestScramSha(t *testing.T) {
+	srv := newTestServer()
+	for _, mech := range []string{"SCRAM-SHA512", "SCRAM-SHA256", "SCRAM-SHA1"} {
+		creds, err := scramAuth(t, srv, mech, "alice", "secret")
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", mech, err)
+		}
+		if creds == nil || creds.Name() != "alice" {
+			t.Fatalf("%s: unexpected creds %v", mech, creds)
+		}
+
+		_, err = scramAuth(t, srv, mech, "alice", "wrong")
+		if err != ErrAuthFailed {
+			t.Fatalf("%s: expected ErrAuthFailed. Got %v", mech, err)
+		}
+
+		_, err = scramAuth(t, srv, mech, "bob", "secret")
+		if err != ErrAuthFailed {
+			t.Fatalf("%s: expected ErrAuthFailed for unknown user. Got %v",
+				mech, err)
+		}
+	}
+}
+
+func TestScramShaEscapedName(t *testing.T) {
+	creds, err := scramAuth(t, newTestServer(), "SCRAM-SHA256", "a=2Cb", "pwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Name() != "a,b" {
+		t.Fatalf("Unexpected user %s", creds.Name())
+	}
+}
+
+func TestScramShaBadMessages(t *testing.T) {
+	srv := newTestServer()
+	for _, msg := range []string{
+		"",
+		"p=tls-unique,,n=alice,r=abc",
+		"n,,r=abc,n=alice",
+		"n,,n=al=ice,r=abc",
+		"n,,n=alice",
+	} {
+		sess, err := srv.Start("SCRAM-SHA512")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = sess.Step([]byte(msg))
+		if err != ErrBadMessage {
+			t.Fatalf("Expected ErrBadMessage for %q. Got %v", msg, err)
+		}
+		_, _, err = sess.Step([]byte("n,,n=alice,r=abc"))
+		if err != ErrBadMessage {
+			t.Fatalf("Failed session must stay failed. Got %v", err)
+		}
+	}
+
+	sess, _ := srv.Start("SCRAM-SHA512")
+	_, _, err := sess.Step([]byte("n,,n=alice,r=abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = sess.Step([]byte("c=biws,r=abc,p=AAAA"))
+	if err != ErrBadMessage {
+		t.Fatalf("Expected nonce mismatch to be rejected. Got %v", err)
+	}
+	if sess.Creds() != nil {
+		t.Fatalf("Failed session must have no creds")
+	}
+}
+
+func TestPlain(t *testing.T) {
+	srv := newTestServer()
+	if _, err := srv.Start("PLAIN"); err != ErrUnsupportedMech {
+		t.Fatalf("PLAIN must not be allowed by default. Got %v", err)
+	}
+
+	srv.AllowPlain = true
+	mechs := srv.Mechanisms()
+	if mechs[0] != "SCRAM-SHA512" || mechs[len(mechs)-1] != "PLAIN" {
+		t.Fatalf("Unexpected mechanisms %v", mechs)
+	}
+
+	for _, tc := range []struct {
+		msg string
+		err error
+	}{
+		{"\x00alice\x00secret", nil},
+		{"alice\x00alice\x00secret", nil},
+		{"\x00alice\x00wrong", ErrAuthFailed},
+		{"bob\x00alice\x00secret", ErrAuthFailed},
+		{"alice\x00secret", ErrBadMessage},
+	} {
+		sess, err := srv.Start("PLAIN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, done, err := sess.Step([]byte(tc.msg))
+		if err != tc.err || done != (err == nil) {
+			t.Fatalf("%q: expected %v. Got %v, %v", tc.msg, tc.err, done, err)
+		}
+		if err == nil && sess.Creds().Name() != "alice" {
+			t.Fatalf("Unexpected creds %v", sess.Creds())
+		}
+	}
+}
+
+func TestUnsupportedMech(t *testing.T) {
+	if _, err := newTestServer().Start("CRAM-MD5"); err != ErrUnsupportedMech {
+		t.Fatalf("Expected ErrUnsupportedMech. Got %v", err)
+	}
+}
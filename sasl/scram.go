@@ -0,0 +1,232 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+type scramMech struct {
+	name string
+	hash func() hash.Hash
+	info func(*cbauthimpl.UserAuthInfo) *cbauthimpl.ScramInfo
+}
+
+// scramMechs lists supported SCRAM-SHA mechanisms, strongest first.
+// Names are the ones used by memcached.
+var scramMechs = []scramMech{
+	{"SCRAM-SHA512", sha512.New,
+		func(i *cbauthimpl.UserAuthInfo) *cbauthimpl.ScramInfo {
+			return i.ScramSha512
+		}},
+	{"SCRAM-SHA256", sha256.New,
+		func(i *cbauthimpl.UserAuthInfo) *cbauthimpl.ScramInfo {
+			return i.ScramSha256
+		}},
+	{"SCRAM-SHA1", sha1.New,
+		func(i *cbauthimpl.UserAuthInfo) *cbauthimpl.ScramInfo {
+			return i.ScramSha1
+		}},
+}
+
+// fakeIterations is iteration count that is reported for unknown
+// users.
+const fakeIterations = 4096
+
+type scramSession struct {
+	s    *Server
+	sess *Session
+	mech *scramMech
+
+	info  *cbauthimpl.ScramInfo
+	creds cbauth.Creds
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func (s *Server) startScram(mech *scramMech) *Session {
+	sess := &Session{mech: mech.name}
+	c := &scramSession{s: s, sess: sess, mech: mech}
+	sess.step = c.first
+	return sess
+}
+
+func hmacSum(h func() hash.Hash, key, msg []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func decodeSaslName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", ErrBadMessage
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// fakeInfo returns SCRAM data that no password matches. Salt is
+// derived from the user name, so repeated attempts for the same
+// unknown user look the same as for an existing one.
+func (c *scramSession) fakeInfo(user string) *cbauthimpl.ScramInfo {
+	h := c.mech.hash
+	salt := hmacSum(sha256.New, c.s.secret, []byte(c.mech.name+"\x00"+user))
+	storedKey := make([]byte, h().Size())
+	rand.Read(storedKey)
+	return &cbauthimpl.ScramInfo{
+		Salt:       salt[:16],
+		Iterations: fakeIterations,
+		StoredKey:  storedKey,
+		ServerKey:  storedKey,
+	}
+}
+
+func (c *scramSession) first(in []byte) ([]byte, bool, error) {
+	msg := string(in)
+	// gs2-header: gs2-cbind-flag "," [authzid] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrBadMessage
+	}
+	switch parts[0] {
+	case "n", "y":
+	default:
+		// channel binding is not supported
+		return nil, false, ErrBadMessage
+	}
+	c.gs2Header = parts[0] + "," + parts[1] + ","
+	c.clientFirstBare = parts[2]
+
+	attrs := strings.Split(c.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") ||
+		!strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, false, ErrBadMessage
+	}
+	user, err := decodeSaslName(attrs[0][2:])
+	if err != nil || user == "" {
+		return nil, false, ErrBadMessage
+	}
+	if parts[1] != "" {
+		authzid, err := decodeSaslName(strings.TrimPrefix(parts[1], "a="))
+		if err != nil || !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, ErrBadMessage
+		}
+		if authzid != user {
+			return nil, false, ErrAuthFailed
+		}
+	}
+
+	info, creds, err := c.s.b.GetUserAuthInfo(user)
+	switch {
+	case err == cbauth.ErrUserNotFound:
+		c.info = c.fakeInfo(user)
+	case err != nil:
+		return nil, false, err
+	default:
+		c.info = c.mech.info(info)
+		c.creds = creds
+		if c.info == nil {
+			// user exists but has no data for this mechanism
+			c.info = c.fakeInfo(user)
+			c.creds = nil
+		}
+	}
+
+	serverNonce := make([]byte, 24)
+	_, err = rand.Read(serverNonce)
+	if err != nil {
+		return nil, false, err
+	}
+	c.nonce = attrs[1][2:] + base64.StdEncoding.EncodeToString(serverNonce)
+	c.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", c.nonce,
+		base64.StdEncoding.EncodeToString(c.info.Salt), c.info.Iterations)
+
+	c.sess.step = c.final
+	return []byte(c.serverFirst), false, nil
+}
+
+func (c *scramSession) final(in []byte) ([]byte, bool, error) {
+	msg := string(in)
+	idx := strings.LastIndex(msg, ",p=")
+	if idx < 0 {
+		return nil, false, ErrBadMessage
+	}
+	withoutProof := msg[:idx]
+	proof, err := base64.StdEncoding.DecodeString(msg[idx+3:])
+	if err != nil {
+		return nil, false, ErrBadMessage
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 {
+		return nil, false, ErrBadMessage
+	}
+	cbind := base64.StdEncoding.EncodeToString([]byte(c.gs2Header))
+	if attrs[0] != "c="+cbind || attrs[1] != "r="+c.nonce {
+		return nil, false, ErrBadMessage
+	}
+
+	h := c.mech.hash
+	if len(proof) != h().Size() {
+		return nil, false, ErrBadMessage
+	}
+
+	authMsg := []byte(c.clientFirstBare + "," + c.serverFirst + "," +
+		withoutProof)
+	clientSignature := hmacSum(h, c.info.StoredKey, authMsg)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if subtle.ConstantTimeCompare(storedKey.Sum(nil), c.info.StoredKey) != 1 ||
+		c.creds == nil {
+		return nil, false, ErrAuthFailed
+	}
+
+	c.sess.creds = c.creds
+	serverSignature := hmacSum(h, c.info.ServerKey, authMsg)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)),
+		true, nil
+}
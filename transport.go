@@ -0,0 +1,183 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// ErrUnsupportedAuthenticator is returned by NewClusterTransport if
+// given authenticator is not the one implemented by cbauth.
+var ErrUnsupportedAuthenticator = errors.New(
+	"authenticator is not implemented by cbauth")
+
+// ErrNoTLSPort is returned by transport of NewClusterTransport when
+// cluster encryption is enabled and request is sent to plain port
+// that has no known TLS counterpart.
+var ErrNoTLSPort = errors.New(
+	"no known TLS port to send request to while cluster encryption is enabled")
+
+// clusterTransport switches intra-cluster requests to TLS ports when
+// cluster encryption is enabled. Underlying http.Transport is rebuilt
+// whenever certificates, TLS config or cluster encryption config
+// change.
+type clusterTransport struct {
+	svc  *cbauthimpl.Svc
+	base *http.Transport
+
+	l       sync.Mutex
+	version uint64
+	encrypt bool
+	tr      *http.Transport
+}
+
+// NewClusterTransport returns http.RoundTripper that is meant for
+// requests to other services of the cluster. It sets service creds
+// on requests the same way WrapHTTPTransport does. When cluster
+// encryption is enabled, requests to plain ports of known services are
+// sent to the corresponding TLS ports instead. TLS connections use
+// cbauth TLS settings and the cluster CA. Connections pool is rebuilt
+// every time CFG_CHANGE_CLUSTER_ENCRYPTION or CFG_CHANGE_CERTS_TLSCONFIG
+// change is observed. Plain http requests that cannot be switched to
+// TLS port while cluster encryption is enabled fail with ErrNoTLSPort
+// rather than go unencrypted.
+//
+// base is used as template for underlying transport. Its
+// TLSClientConfig (i.e. client certificates) is preserved except for
+// RootCAs, MinVersion and CipherSuites. If base is nil,
+// http.DefaultTransport is used. As usual, if nil authenticator is
+// passed, default authenticator is used.
+func NewClusterTransport(a Authenticator,
+	base *http.Transport) (http.RoundTripper, error) {
+	var rv http.RoundTripper
+	err := WithAuthenticator(a, func(a Authenticator) error {
+		impl, ok := a.(*authImpl)
+		if !ok {
+			return ErrUnsupportedAuthenticator
+		}
+		if base == nil {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		rv = WrapHTTPTransport(&clusterTransport{
+			svc:  impl.svc,
+			base: base,
+		}, a)
+		return nil
+	})
+	return rv, err
+}
+
+func (t *clusterTransport) newTransport() (*http.Transport, bool, error) {
+	encCfg, err := cbauthimpl.GetClusterEncryptionConfig(t.svc)
+	if err != nil {
+		return nil, false, err
+	}
+	pool, err := cbauthimpl.GetClusterCAPool(t.svc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tr := t.base.Clone()
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.RootCAs = pool
+
+	// it's ok for tls config to be missing, in which case we stay with
+	// go defaults
+	tlsCfg, err := cbauthimpl.GetTLSConfig(t.svc)
+	if err == nil {
+		tr.TLSClientConfig.MinVersion = tlsCfg.MinVersion
+		tr.TLSClientConfig.CipherSuites = tlsCfg.CipherSuites
+	}
+
+	return tr, encCfg.EncryptData, nil
+}
+
+func (t *clusterTransport) getTransport() (*http.Transport, bool, error) {
+	version := cbauthimpl.GetConfigVersion(t.svc)
+
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.tr != nil && t.version == version {
+		return t.tr, t.encrypt, nil
+	}
+
+	tr, encrypt, err := t.newTransport()
+	if err != nil {
+		return nil, false, err
+	}
+	if t.tr != nil {
+		t.tr.CloseIdleConnections()
+	}
+	t.tr = tr
+	t.encrypt = encrypt
+	t.version = version
+	return tr, encrypt, nil
+}
+
+func (t *clusterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr, encrypt, err := t.getTransport()
+	if err != nil {
+		return nil, err
+	}
+	if !encrypt || req.URL.Scheme != "http" {
+		return tr.RoundTrip(req)
+	}
+
+	host, port, err := SplitHostPort(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	tlsPort, err := cbauthimpl.GetTLSPort(t.svc, host, port)
+	if err != nil && err != cbauthimpl.ErrUnknownHostPort {
+		return nil, err
+	}
+	if tlsPort == 0 {
+		// not a cluster service we know TLS port of
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrNoTLSPort
+	}
+
+	u := *req.URL
+	u.Scheme = "https"
+	u.Host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+	r := *req
+	r.URL = &u
+	if r.Host == req.URL.Host {
+		r.Host = u.Host
+	}
+	return tr.RoundTrip(&r)
+}
+
+// CloseIdleConnections closes idle connections of underlying transport.
+func (t *clusterTransport) CloseIdleConnections() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.tr != nil {
+		t.tr.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,90 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2023 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Clock is source of time for code that waits. It exists so that such
+// code can be tested without actually waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is Clock that uses real time.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time { return time.Now() }
+
+// After returns time.After(d).
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep waits for d according to clock. It returns ctx.Err() if ctx
+// gets done first.
+func Sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(d):
+		return nil
+	}
+}
+
+// Backoff computes delays between retries: random duration ("full
+// jitter") of up to exponentially growing backoff that starts at
+// Initial and is capped by Max. This way clients that failed at the
+// same time don't retry in lockstep.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	// Int63n, if non-nil, replaces rand.Int63n as source of jitter.
+	Int63n func(n int64) int64
+
+	attempt int
+}
+
+// Next returns delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	rv := b.Initial
+	for i := 0; i < b.attempt && rv < b.Max; i++ {
+		rv *= 2
+	}
+	if rv > b.Max {
+		rv = b.Max
+	}
+	b.attempt++
+	int63n := b.Int63n
+	if int63n == nil {
+		int63n = rand.Int63n
+	}
+	return time.Duration(int63n(int64(rv) + 1))
+}
+
+// Attempts returns how many delays were returned since the last
+// Reset.
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Reset makes backoff start from Initial again.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}